@@ -0,0 +1,220 @@
+package extfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const EXT4_SUPERBLOCK_CHECKSUM_OFFSET = 0x3fc
+const EXT4_BG_CHECKSUM_OFFSET = 0x1e
+const EXT4_MAX_LOG_BLOCK_SIZE = 6 // 64KiB
+
+const badMagicProblem = "invalid superblock magic"
+
+// SuperBlockCopy tells which superblock and group descriptor table the filesystem was read from.
+type SuperBlockCopy struct {
+	Group  uint32 // 0 is the primary copy
+	Offset int64  // the byte offset of the superblock from the filesystem start (see Options.ImageOffset)
+	Reason string // why the primary copy wasn't used, empty if it was
+}
+
+// SuperBlockCopy returns the superblock copy in use.
+func (e *ExtFileSystem) SuperBlockCopy() SuperBlockCopy {
+	return e.superBlockCopy
+}
+
+// ReadSuperBlockCopy reports which superblock copy the image at targetPath is read from.
+func ReadSuperBlockCopy(targetPath string, options Options) (SuperBlockCopy, error) {
+	fs, err := Open(targetPath, options)
+	if err != nil {
+		return SuperBlockCopy{}, err
+	}
+	defer fs.Close()
+	return fs.SuperBlockCopy(), nil
+}
+
+// hasSuperBlockBackup tells if the group keeps a copy of the superblock and the descriptors, as ext4_bg_has_super.
+// With sparse_super2 only the groups of s_backup_bgs do, group 1 included.
+func (s *SuperBlock) hasSuperBlockBackup(group uint32) bool {
+	if group == 0 {
+		return true
+	}
+	if s.s_feature_compat&EXT4_FEATURE_COMPAT_SPARSE_SUPER2 != 0 {
+		return group == s.s_backup_bgs[0] || group == s.s_backup_bgs[1]
+	}
+	if group == 1 || s.s_feature_ro_compat&EXT4_FEATURE_RO_COMPAT_SPARSE_SUPER == 0 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		power := base
+		for power < group {
+			power *= base
+		}
+		if power == group {
+			return true
+		}
+	}
+	return false
+}
+
+// csumSeed returns the seed of the metadata checksums.
+func (s *SuperBlock) csumSeed() uint32 {
+	if s.s_feature_incompat&EXT4_FEATURE_INCOMPAT_CSUM_SEED != 0 {
+		return s.s_checksum_seed
+	}
+	return crc32c(^uint32(0), s.s_uuid)
+}
+
+// selectSuperBlock sets superBlockOffset to the copy the filesystem is read from: the one of
+// Options.SuperBlockGroup, the primary one or, if the primary superblock or descriptors are damaged,
+// the first valid backup. The copy and the reason of the fallback are kept for SuperBlockCopy.
+func (e *ExtFileSystem) selectSuperBlock(reader MmapCustomReader) error {
+	if group := e.options.SuperBlockGroup; group != 0 {
+		for _, offset := range e.backupOffsets(reader, group) {
+			if e.checkMetadata(reader, offset, group) == "" {
+				e.superBlockOffset = offset
+				e.superBlockCopy = SuperBlockCopy{Group: group, Offset: offset, Reason: "selected by the options"}
+				return nil
+			}
+		}
+		return newError("parse", ErrCorrupt, "there is no valid superblock backup in group %d", group)
+	}
+	problem := e.checkMetadata(reader, e.superBlockOffset, 0)
+	if problem == "" {
+		e.superBlockCopy = SuperBlockCopy{Offset: e.superBlockOffset}
+		return nil
+	}
+	for group := uint32(1); ; group++ {
+		offsets := e.backupOffsets(reader, group)
+		if offsets == nil {
+			break
+		}
+		for _, offset := range offsets {
+			if e.checkMetadata(reader, offset, group) == "" {
+				e.superBlockOffset = offset
+				e.superBlockCopy = SuperBlockCopy{Group: group, Offset: offset, Reason: problem}
+				return nil
+			}
+		}
+	}
+	sentinel := ErrCorrupt
+	if problem == badMagicProblem {
+		sentinel = ErrBadMagic // most likely not an ext filesystem at all
+	}
+	return newError("parse", sentinel, "%s and no valid backup superblock was found", problem)
+}
+
+// backupOffsets returns the possible positions of the group superblock inside the image. The geometry is
+// taken from the primary superblock if it has the magic, then from Options.BlocksPerGroup and then
+// the mke2fs default of 8 * blocksize blocks per group is tried for every blocksize. A primary superblock
+// that can't be read gives no geometry.
+// It returns nil when the group is out of the image with every geometry.
+func (e *ExtFileSystem) backupOffsets(reader MmapCustomReader, group uint32) (offsets []int64) {
+	type geometry struct{ blocksize, blocksPerGroup, firstDataBlock uint64 }
+	var geometries []geometry
+	var primary SuperBlock
+	reader.SetCursorValue(e.superBlockOffset)
+	if primary.Parse(reader) == nil && primary.s_magic == 0xef53 && primary.s_log_block_size <= EXT4_MAX_LOG_BLOCK_SIZE {
+		geometries = append(geometries,
+			geometry{primary.Blocksize(), uint64(primary.s_blocks_per_group), uint64(primary.s_first_data_block)})
+	}
+	for logBlocksize := uint64(0); logBlocksize <= EXT4_MAX_LOG_BLOCK_SIZE; logBlocksize++ {
+		blocksize := uint64(1024) << logBlocksize
+		firstDataBlock := uint64(0)
+		if blocksize == 1024 {
+			firstDataBlock = 1
+		}
+		if e.options.BlocksPerGroup != 0 {
+			geometries = append(geometries, geometry{blocksize, uint64(e.options.BlocksPerGroup), firstDataBlock})
+		}
+		geometries = append(geometries, geometry{blocksize, 8 * blocksize, firstDataBlock})
+	}
+	seen := make(map[int64]bool)
+	for _, g := range geometries {
+		offset := int64((uint64(group)*g.blocksPerGroup + g.firstDataBlock) * g.blocksize)
+		if offset+int64(g.blocksize) <= reader.size() && !seen[offset] {
+			seen[offset] = true
+			offsets = append(offsets, offset)
+		}
+	}
+	return
+}
+
+// checkMetadata validates the superblock at the offset and the descriptor table following it.
+// It returns what is wrong, an empty string if nothing is.
+func (e *ExtFileSystem) checkMetadata(reader MmapCustomReader, offset int64, group uint32) string {
+	var super SuperBlock
+	if offset+1024 > reader.size() {
+		return "the superblock is out of the image"
+	}
+	reader.SetCursorValue(offset)
+	if super.Parse(reader) != nil {
+		return "the superblock can't be read"
+	}
+	if super.s_magic != 0xef53 {
+		return badMagicProblem
+	}
+	if super.s_log_block_size > EXT4_MAX_LOG_BLOCK_SIZE || super.s_inodes_per_group == 0 ||
+		super.s_blocks_per_group == 0 || super.s_inodes_count == 0 ||
+		super.s_rev_level != 0 && (super.s_inode_size < 128 || super.s_inode_size&(super.s_inode_size-1) != 0 ||
+			uint64(super.s_inode_size) > super.Blocksize()) {
+		return "invalid superblock geometry"
+	}
+	if group != 0 && (uint32(super.s_block_group_nr) != group ||
+		uint64(offset) != (uint64(group)*uint64(super.s_blocks_per_group)+uint64(super.s_first_data_block))*super.Blocksize()) {
+		return "the superblock belongs to another group"
+	}
+	if group != 0 && !super.hasSuperBlockBackup(group) {
+		return "the group has no superblock backup"
+	}
+	if super.s_feature_ro_compat&EXT4_FEATURE_RO_COMPAT_METADATA_CSUM != 0 {
+		reader.SetCursorValue(offset)
+		raw := reader.ReadN(EXT4_SUPERBLOCK_CHECKSUM_OFFSET)
+		if reader.Err() != nil {
+			return "the superblock can't be read"
+		}
+		if crc32c(^uint32(0), raw) != super.s_checksum {
+			return "superblock checksum mismatch"
+		}
+	}
+	if super.s_feature_incompat&EXT4_FEATURE_INCOMPAT_META_BG != 0 {
+		return "" // the descriptors are spread over the meta groups, checkFeatures refuses it
+	}
+	candidate := ExtFileSystem{superBlockOffset: offset, options: e.options}
+	candidate.super = super
+	descSize := int64(candidate.descSize())
+	descPosition := int64(candidate.getBlockGroupDescPosition())
+	if descPosition+descSize*int64(super.Ngroups()) > reader.size() {
+		return "the group descriptors are out of the image"
+	}
+	if candidate.parseMetadata(reader) != nil {
+		return "the group descriptors can't be read"
+	}
+	blocksCount := super.BlocksCount()
+	itableBlocks := (uint64(super.s_inodes_per_group)*uint64(super.s_inode_size) + super.Blocksize() - 1) / super.Blocksize()
+	seed := super.csumSeed()
+	for n, desc := range candidate.bgdescs {
+		for _, block := range []uint64{desc.getBlockBitmapBlock(), desc.getInodeBitmapBlock(), desc.getLocalInodeTableStartBlock()} {
+			if block < uint64(super.s_first_data_block) || block >= blocksCount {
+				return fmt.Sprintf("the descriptor of group %d points out of the filesystem", n)
+			}
+		}
+		if desc.getLocalInodeTableStartBlock()+itableBlocks > blocksCount {
+			return fmt.Sprintf("the inode table of group %d is out of the filesystem", n)
+		}
+		if super.s_feature_ro_compat&EXT4_FEATURE_RO_COMPAT_METADATA_CSUM != 0 {
+			reader.SetCursorValue(descPosition + int64(n)*descSize)
+			raw := reader.ReadN(descSize)
+			if reader.Err() != nil {
+				return "the group descriptors can't be read"
+			}
+			stored := binary.LittleEndian.Uint16(raw[EXT4_BG_CHECKSUM_OFFSET:])
+			raw[EXT4_BG_CHECKSUM_OFFSET], raw[EXT4_BG_CHECKSUM_OFFSET+1] = 0, 0
+			groupNumber := binary.LittleEndian.AppendUint32(nil, uint32(n))
+			if uint16(crc32c(crc32c(seed, groupNumber), raw)) != stored {
+				return fmt.Sprintf("descriptor checksum mismatch in group %d", n)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+package extfs
+
+// GroupDescriptor is the decoded descriptor of a block group. With flex_bg the bitmaps and the inode table
+// of the groups of a flex group are packed together, usually into its first group, so they may lie outside
+// of the group they describe.
+type GroupDescriptor struct {
+	Group               uint32
+	FlexGroup           uint32 // the flex group the group belongs to, equals Group without flex_bg
+	FirstBlock          uint64
+	BlocksCount         uint64 // the last group may be shorter than s_blocks_per_group
+	BlockBitmap         uint64
+	InodeBitmap         uint64
+	InodeTable          uint64
+	InodeTableBlocks    uint64
+	FreeBlocksCount     uint32
+	FreeInodesCount     uint32
+	UsedDirsCount       uint32
+	Flags               uint16 // EXT4_BG_INODE_UNINIT, EXT4_BG_BLOCK_UNINIT and EXT4_BG_INODE_ZEROED
+	ExcludeBitmap       uint64
+	BlockBitmapChecksum uint32
+	InodeBitmapChecksum uint32
+	ItableUnused        uint32 // the inodes at the end of the table that were never used
+	Checksum            uint16
+}
+
+// BlockRange is a run of blocks that are all used or all free.
+type BlockRange struct {
+	Start  uint64
+	Length uint64
+	Used   bool
+}
+
+// GroupDescriptors returns the descriptors of all the groups.
+func (e *ExtFileSystem) GroupDescriptors() []GroupDescriptor {
+	descriptors := make([]GroupDescriptor, len(e.bgdescs))
+	for group := range e.bgdescs {
+		descriptors[group] = e.describeGroup(uint32(group))
+	}
+	return descriptors
+}
+
+func (e *ExtFileSystem) groupDescriptor(group uint32) (GroupDescriptor, error) {
+	if group >= uint32(len(e.bgdescs)) {
+		return GroupDescriptor{}, newError("group", ErrBlockOutOfRange, "group %d, the filesystem has %d", group, len(e.bgdescs))
+	}
+	return e.describeGroup(group), nil
+}
+
+// describeGroup decodes the descriptor of the group, the caller keeps the group in range.
+func (e *ExtFileSystem) describeGroup(group uint32) GroupDescriptor {
+	descriptor := e.bgdescs[group].describe()
+	descriptor.Group = group
+	descriptor.FlexGroup = group
+	if e.super.s_feature_incompat&EXT4_FEATURE_INCOMPAT_FLEX_BG != 0 {
+		descriptor.FlexGroup = group >> e.super.s_log_groups_per_flex
+	}
+	descriptor.FirstBlock = uint64(e.super.s_first_data_block) + uint64(group)*uint64(e.super.s_blocks_per_group)
+	descriptor.BlocksCount = min(uint64(e.super.s_blocks_per_group), e.super.BlocksCount()-descriptor.FirstBlock)
+	blocksize := e.super.Blocksize()
+	descriptor.InodeTableBlocks = (uint64(e.super.s_inodes_per_group)*uint64(e.super.s_inode_size) + blocksize - 1) / blocksize
+	return descriptor
+}
+
+// ReadBlock returns the content of the block. The journal overlay applies when the journal is replayed.
+func (e *ExtFileSystem) ReadBlock(block uint64) (data []byte, err error) {
+	return e.super.readBlock(block)
+}
+
+// BlockAllocated tells if the block is in use according to the block bitmap of its group. The blocks before
+// s_first_data_block (the boot block of 1K filesystems) belong to no group and are reported as used.
+func (e *ExtFileSystem) BlockAllocated(block uint64) (allocated bool, err error) {
+	if block >= e.super.BlocksCount() {
+		return false, newError("block bitmap", ErrBlockOutOfRange, "block %d, the filesystem has %d", block, e.super.BlocksCount())
+	}
+	if block < uint64(e.super.s_first_data_block) {
+		return true, nil
+	}
+	block -= uint64(e.super.s_first_data_block)
+	bitmap, err := e.blockBitmap(uint32(block / uint64(e.super.s_blocks_per_group)))
+	if err != nil {
+		return false, err
+	}
+	bit := block % uint64(e.super.s_blocks_per_group)
+	return bitmap[bit/8]&(1<<(bit%8)) != 0, nil
+}
+
+// InodeAllocated tells if the inode is in use according to the inode bitmap of its group.
+func (e *ExtFileSystem) InodeAllocated(inodeNumber uint32) (allocated bool, err error) {
+	if inodeNumber == 0 || inodeNumber > e.super.s_inodes_count {
+		return false, newError("inode bitmap", ErrInodeOutOfRange, "inode %d, the filesystem has %d", inodeNumber, e.super.s_inodes_count)
+	}
+	return e.inodeAllocated(inodeNumber)
+}
+
+// BlockRanges splits the blocks of the group into the runs of used and free ones, in the block order.
+func (e *ExtFileSystem) BlockRanges(group uint32) (ranges []BlockRange, err error) {
+	descriptor, err := e.groupDescriptor(group)
+	if err != nil {
+		return nil, err
+	}
+	bitmap, err := e.blockBitmap(group)
+	if err != nil {
+		return nil, err
+	}
+	for bit := uint64(0); bit < descriptor.BlocksCount; bit++ {
+		used := bitmap[bit/8]&(1<<(bit%8)) != 0
+		if last := len(ranges) - 1; last >= 0 && ranges[last].Used == used {
+			ranges[last].Length++
+			continue
+		}
+		ranges = append(ranges, BlockRange{Start: descriptor.FirstBlock + bit, Length: 1, Used: used})
+	}
+	return ranges, nil
+}
+
+// blockBitmap returns the block bitmap of the group. Groups with BLOCK_UNINIT have no bitmap on the disk,
+// it's built as the kernel does: only the superblock backup, the descriptor tables and the bitmaps and
+// the inode table of the group that lie inside of it are used. Bitmaps of bigalloc filesystems,
+// whose bits are clusters, and the built bitmaps of meta_bg ones fail with ErrUnsupportedFeature.
+func (e *ExtFileSystem) blockBitmap(group uint32) ([]byte, error) {
+	if e.super.s_feature_ro_compat&EXT4_FEATURE_RO_COMPAT_BIGALLOC != 0 {
+		return nil, newError("block bitmap", ErrUnsupportedFeature, "bigalloc: the bitmap bits are clusters")
+	}
+	descriptor, err := e.groupDescriptor(group)
+	if err != nil {
+		return nil, err
+	}
+	blocksize := e.super.Blocksize()
+	if descriptor.Flags&EXT4_BG_BLOCK_UNINIT == 0 {
+		return e.super.readBlock(descriptor.BlockBitmap)
+	}
+	if e.super.s_feature_incompat&EXT4_FEATURE_INCOMPAT_META_BG != 0 {
+		return nil, newError("block bitmap", ErrUnsupportedFeature, "meta_bg: group %d has no bitmap and its descriptor blocks are spread", group)
+	}
+	bitmap := make([]byte, blocksize)
+	markUsed := func(first uint64, count uint64) {
+		for block := first; block < first+count; block++ {
+			if block >= descriptor.FirstBlock && block < descriptor.FirstBlock+descriptor.BlocksCount {
+				bit := block - descriptor.FirstBlock
+				bitmap[bit/8] |= 1 << (bit % 8)
+			}
+		}
+	}
+	if e.super.hasSuperBlockBackup(group) {
+		gdtBlocks := (uint64(e.super.Ngroups())*uint64(e.descSize()) + blocksize - 1) / blocksize
+		markUsed(descriptor.FirstBlock, 1+gdtBlocks+uint64(e.super.s_reserved_gdt_blocks))
+	}
+	markUsed(descriptor.BlockBitmap, 1)
+	markUsed(descriptor.InodeBitmap, 1)
+	markUsed(descriptor.InodeTable, descriptor.InodeTableBlocks)
+	return bitmap, nil
+}
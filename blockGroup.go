@@ -3,7 +3,12 @@ package extfs
 type BlockGroupDescriptor interface {
 	parse(reader *MmapCustomReader)
 	getLocalInodeTableStartBlock() uint64
+	getBlockBitmapBlock() uint64
+	getInodeBitmapBlock() uint64
+	getFlags() uint16
+	getExcludeBitmapBlock() uint64
 	getSize() int
+	describe() GroupDescriptor
 }
 
 type DefaultBlockGroupDescriptor struct {
@@ -15,6 +20,12 @@ type DefaultBlockGroupDescriptor struct {
 	bg_free_inodes_count uint16
 	bg_used_dirs_count   uint16
 	bg_pad               uint16
+	bg_exclude_bitmap    uint32 // ext4 with exclude_bitmap
+	// the fields below are used by ext4 with uninit_bg or metadata_csum, they are zero on ext2/3
+	bg_block_bitmap_csum uint16
+	bg_inode_bitmap_csum uint16
+	bg_itable_unused     uint16
+	bg_checksum          uint16
 }
 
 func (b *DefaultBlockGroupDescriptor) parse(reader *MmapCustomReader) {
@@ -25,6 +36,11 @@ func (b *DefaultBlockGroupDescriptor) parse(reader *MmapCustomReader) {
 	b.bg_free_inodes_count = reader.Read16le(2)
 	b.bg_used_dirs_count = reader.Read16le(2)
 	b.bg_pad = reader.Read16le(2)
+	b.bg_exclude_bitmap = reader.Read32le(4)
+	b.bg_block_bitmap_csum = reader.Read16le(2)
+	b.bg_inode_bitmap_csum = reader.Read16le(2)
+	b.bg_itable_unused = reader.Read16le(2)
+	b.bg_checksum = reader.Read16le(2)
 	b.size = 32
 }
 
@@ -32,10 +48,44 @@ func (b *DefaultBlockGroupDescriptor) getLocalInodeTableStartBlock() uint64 {
 	return uint64(b.bg_inode_table)
 }
 
+func (b *DefaultBlockGroupDescriptor) getBlockBitmapBlock() uint64 {
+	return uint64(b.bg_block_bitmap)
+}
+
+func (b *DefaultBlockGroupDescriptor) getInodeBitmapBlock() uint64 {
+	return uint64(b.bg_inode_bitmap)
+}
+
+// getFlags returns bg_flags, which ext4 keeps in place of bg_pad (it's zero on ext2/3).
+func (b *DefaultBlockGroupDescriptor) getFlags() uint16 {
+	return b.bg_pad
+}
+
+func (b *DefaultBlockGroupDescriptor) getExcludeBitmapBlock() uint64 {
+	return uint64(b.bg_exclude_bitmap)
+}
+
 func (b *DefaultBlockGroupDescriptor) getSize() int {
 	return b.size
 }
 
+func (b *DefaultBlockGroupDescriptor) describe() GroupDescriptor {
+	return GroupDescriptor{
+		BlockBitmap:         uint64(b.bg_block_bitmap),
+		InodeBitmap:         uint64(b.bg_inode_bitmap),
+		InodeTable:          uint64(b.bg_inode_table),
+		FreeBlocksCount:     uint32(b.bg_free_blocks_count),
+		FreeInodesCount:     uint32(b.bg_free_inodes_count),
+		UsedDirsCount:       uint32(b.bg_used_dirs_count),
+		Flags:               b.bg_pad,
+		ExcludeBitmap:       uint64(b.bg_exclude_bitmap),
+		BlockBitmapChecksum: uint32(b.bg_block_bitmap_csum),
+		InodeBitmapChecksum: uint32(b.bg_inode_bitmap_csum),
+		ItableUnused:        uint32(b.bg_itable_unused),
+		Checksum:            b.bg_checksum,
+	}
+}
+
 func DefaultBlockGroupDescriptorFabric() BlockGroupDescriptor {
 	return &DefaultBlockGroupDescriptor{size: 32}
 }
@@ -98,10 +148,43 @@ func (e *Ext4BlockGroupDescriptor) getLocalInodeTableStartBlock() uint64 {
 	return (uint64(e.bg_inode_table_hi) << 32) | uint64(e.bg_inode_table_lo)
 }
 
+func (e *Ext4BlockGroupDescriptor) getBlockBitmapBlock() uint64 {
+	return (uint64(e.bg_block_bitmap_hi) << 32) | uint64(e.bg_block_bitmap_lo)
+}
+
+func (e *Ext4BlockGroupDescriptor) getInodeBitmapBlock() uint64 {
+	return (uint64(e.bg_inode_bitmap_hi) << 32) | uint64(e.bg_inode_bitmap_lo)
+}
+
+func (e *Ext4BlockGroupDescriptor) getFlags() uint16 {
+	return e.bg_flags
+}
+
+func (e *Ext4BlockGroupDescriptor) getExcludeBitmapBlock() uint64 {
+	return (uint64(e.bg_exclude_bitmap_hi) << 32) | uint64(e.bg_exclude_bitmap_lo)
+}
+
 func (e *Ext4BlockGroupDescriptor) getSize() int {
 	return e.size
 }
 
+func (e *Ext4BlockGroupDescriptor) describe() GroupDescriptor {
+	return GroupDescriptor{
+		BlockBitmap:         e.getBlockBitmapBlock(),
+		InodeBitmap:         e.getInodeBitmapBlock(),
+		InodeTable:          e.getLocalInodeTableStartBlock(),
+		FreeBlocksCount:     uint32(e.bg_free_blocks_count_hi)<<16 | uint32(e.bg_free_blocks_count_lo),
+		FreeInodesCount:     uint32(e.bg_free_inodes_count_hi)<<16 | uint32(e.bg_free_inodes_count_lo),
+		UsedDirsCount:       uint32(e.bg_used_dirs_count_hi)<<16 | uint32(e.bg_used_dirs_count_lo),
+		Flags:               e.bg_flags,
+		ExcludeBitmap:       e.getExcludeBitmapBlock(),
+		BlockBitmapChecksum: uint32(e.bg_block_bitmap_csum_hi)<<16 | uint32(e.bg_block_bitmap_csum_lo),
+		InodeBitmapChecksum: uint32(e.bg_inode_bitmap_csum_hi)<<16 | uint32(e.bg_inode_bitmap_csum_lo),
+		ItableUnused:        uint32(e.bg_itable_unused_hi)<<16 | uint32(e.bg_itable_unused_lo),
+		Checksum:            e.bg_checksum,
+	}
+}
+
 func Ext4BlockGroupDescriptorFabric() BlockGroupDescriptor {
 	return &Ext4BlockGroupDescriptor{size: 64}
 }
@@ -121,8 +204,9 @@ func (b *BlockGroup) parse(super SuperBlock, descBlock BlockGroupDescriptor) {
 	b.inodesize = uint64(super.s_inode_size)
 }
 
-func (b *BlockGroup) getInode(inodeNum uint32) (inode DefaultInodeTable) {
-	b.reader.SetCursorValue(int64(b.itableoffset + b.inodesize*uint64(inodeNum)))
-	inode.parse(&b.reader)
+func (b *BlockGroup) getInode(inodeNum uint32) (inode DefaultInodeTable, err error) {
+	reader := b.reader // a copy, the group is shared by concurrent lookups
+	reader.SetCursorValue(int64(b.itableoffset + b.inodesize*uint64(inodeNum)))
+	err = inode.parse(&reader, b.inodesize)
 	return
 }
@@ -0,0 +1,76 @@
+package extfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The sentinels the errors of the package wrap, check them with errors.Is.
+var (
+	ErrBadMagic           = errors.New("bad magic")
+	ErrBlockOutOfRange    = errors.New("block out of range")
+	ErrInodeOutOfRange    = errors.New("inode out of range")
+	ErrCorruptExtent      = errors.New("corrupt extent header")
+	ErrCorrupt            = errors.New("corrupt metadata")
+	ErrIO                 = errors.New("I/O failure")
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+	ErrInvalidOptions     = errors.New("invalid options")
+	ErrNotDir             = errors.New("not a directory")
+	ErrNotRegular         = errors.New("not a regular file")
+	ErrSymlinkLoop        = errors.New("too many levels of symbolic links")
+)
+
+// Error is the error the package returns. Inode and Path tell where it happened when it's known.
+type Error struct {
+	Op    string // the failed operation, e.g. "extent parse"
+	Inode uint32 // zero if the error isn't bound to an inode
+	Path  string // the image path of the inode, empty if unknown
+	Err   error  // wraps one of the sentinels
+	host  bool   // the failure of the filesystem the image is extracted to
+}
+
+func (e *Error) Error() string {
+	message := "extfs " + e.Op
+	if e.Inode != 0 {
+		message += fmt.Sprintf(": inode %d", e.Inode)
+		if e.Path != "" {
+			message += fmt.Sprintf(" (%s)", e.Path)
+		}
+	}
+	return message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// errStop is returned by the callback of a walker to end the walk early. The walkers pass it up like
+// any other error, the caller that started the walk drops it.
+var errStop = errors.New("stop the walk")
+
+// newError returns the failure of the parsing.
+func newError(op string, sentinel error, format string, args ...any) *Error {
+	return &Error{Op: op, Err: fmt.Errorf("%w: "+format, append([]any{sentinel}, args...)...)}
+}
+
+// ioError returns the failure caused by the error of the underlying file.
+func ioError(op string, err error) *Error {
+	return &Error{Op: op, Err: fmt.Errorf("%w: %w", ErrIO, err)}
+}
+
+// hostError returns the failure of the filesystem the image is extracted to.
+// Unlike the damage of the image, it's never salvaged.
+func hostError(op string, err error) *Error {
+	return &Error{Op: op, Err: fmt.Errorf("%w: %w", ErrIO, err), host: true}
+}
+
+// inodeContext is deferred around the work on an inode: it binds the failure the work returns in err to the inode
+// and its path, unless an inner one has already bound it to another inode. The path may be empty.
+func inodeContext(err *error, inodeNumber uint32, path string) {
+	if failure, ok := (*err).(*Error); ok {
+		if failure.Inode == 0 || failure.Inode == inodeNumber && failure.Path == "" {
+			failure.Inode = inodeNumber
+			failure.Path = path
+		}
+	}
+}
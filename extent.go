@@ -1,6 +1,14 @@
 package extfs
 
-import "log"
+import "sort"
+
+const EXT4_EXT_MAGIC = 0xf30a
+const EXT_INIT_MAX_LEN = 1 << 15
+const EXT_UNWRITTEN_MAX_LEN = EXT_INIT_MAX_LEN - 1
+const EXT4_MAX_EXTENT_DEPTH = 5
+
+// EXT4_EXTENT_ROOT_ENTRIES is how many entries fit into i_block after the header.
+const EXT4_EXTENT_ROOT_ENTRIES = 4
 
 type ExtentHeader struct {
 	magic      uint16
@@ -20,7 +28,9 @@ func (e *ExtentHeader) parse(reader *MmapCustomReader) {
 
 type ExtentNode interface {
 	extent()
-	enumBlocks(SuperBlock, func(*MmapCustomReader) bool) bool
+	enumRuns(SuperBlock, func(blockRun) error) error
+	enumMetadataBlocks(SuperBlock, func(uint64) error) error
+	firstBlock() uint64
 	parse(*MmapCustomReader)
 }
 
@@ -46,15 +56,25 @@ func (e *ExtentLeaf) startblock() uint64 {
 	return uint64(e.start_hi)<<32 | uint64(e.start_lo)
 }
 
-func (e *ExtentLeaf) enumBlocks(super SuperBlock, cb func(reader *MmapCustomReader) bool) bool {
-	blk := e.startblock()
-	for i := 0; int16(i) < int16(e.len); i++ {
-		if !cb(super.GetBlock(blk)) {
-			return false
-		}
-		blk++
+func (e *ExtentLeaf) firstBlock() uint64 {
+	return uint64(e.block)
+}
+
+func (e *ExtentLeaf) run() blockRun {
+	run := blockRun{logical: uint64(e.block), physical: e.startblock(), length: uint64(e.len)}
+	if e.len > EXT_INIT_MAX_LEN { // the high bit of ee_len marks unwritten extents
+		run.length -= EXT_INIT_MAX_LEN
+		run.unwritten = true
 	}
-	return true
+	return run
+}
+
+func (e *ExtentLeaf) enumRuns(super SuperBlock, cb func(run blockRun) error) error {
+	return cb(e.run())
+}
+
+func (e *ExtentLeaf) enumMetadataBlocks(super SuperBlock, cb func(block uint64) error) error {
+	return nil
 }
 
 type ExtentInternal struct {
@@ -62,6 +82,7 @@ type ExtentInternal struct {
 	leaf_lo uint32
 	leaf_hi uint16
 	unused  uint16
+	depth   uint16 // the depth of the node holding the entry, not on the disk
 }
 
 func (e *ExtentInternal) extent() { // sign-method
@@ -75,8 +96,48 @@ func (e *ExtentInternal) parse(reader *MmapCustomReader) {
 	e.unused = reader.Read16le(2)
 }
 
-func (e *ExtentInternal) enumBlocks(super SuperBlock, cb func(reader *MmapCustomReader) bool) bool {
-	return true
+func (e *ExtentInternal) firstBlock() uint64 {
+	return uint64(e.block)
+}
+
+func (e *ExtentInternal) leaf() uint64 {
+	return uint64(e.leaf_hi)<<32 | uint64(e.leaf_lo)
+}
+
+// child parses the node the entry points to. Its depth must be one less than the one of the entry,
+// so an index that points back to its own block or to an ancestor can't recurse forever.
+func (e *ExtentInternal) child(super SuperBlock) (child Extent, err error) {
+	reader, err := super.GetBlock(e.leaf())
+	if err != nil {
+		return child, err
+	}
+	if err = child.parse(reader, uint16((super.Blocksize()-12)/12)); err != nil {
+		return child, err
+	}
+	if child.extHeader.depth+1 != e.depth {
+		return child, newError("extent parse", ErrCorruptExtent, "index block %d has depth %d under depth %d",
+			e.leaf(), child.extHeader.depth, e.depth)
+	}
+	return child, nil
+}
+
+func (e *ExtentInternal) enumRuns(super SuperBlock, cb func(run blockRun) error) error {
+	child, err := e.child(super)
+	if err != nil {
+		return cb(blockRun{logical: uint64(e.block), physical: e.leaf(), damage: err})
+	}
+	return child.enumRuns(super, cb)
+}
+
+func (e *ExtentInternal) enumMetadataBlocks(super SuperBlock, cb func(block uint64) error) error {
+	if err := cb(e.leaf()); err != nil {
+		return err
+	}
+	child, err := e.child(super)
+	if err != nil {
+		return err
+	}
+	return child.enumMetadataBlocks(super, cb)
 }
 
 type Extent struct {
@@ -84,10 +145,22 @@ type Extent struct {
 	extents   []ExtentNode
 }
 
-func (e *Extent) parse(reader *MmapCustomReader) {
+// parse reads the node, capacity is how many entries fit into the space it's in: EXT4_EXTENT_ROOT_ENTRIES in
+// the inode and (blocksize-12)/12 in a block.
+func (e *Extent) parse(reader *MmapCustomReader, capacity uint16) error {
 	e.extHeader.parse(reader)
-	if e.extHeader.magic != 0xf30a {
-		log.Panicf("parse: invalid extent hdr magic: %d\n", e.extHeader.magic)
+	if err := reader.Err(); err != nil {
+		return err
+	}
+	if e.extHeader.magic != EXT4_EXT_MAGIC {
+		return newError("extent parse", ErrCorruptExtent, "invalid magic %#x", e.extHeader.magic)
+	}
+	if e.extHeader.depth > EXT4_MAX_EXTENT_DEPTH {
+		return newError("extent parse", ErrCorruptExtent, "depth %d", e.extHeader.depth)
+	}
+	if e.extHeader.max > capacity || e.extHeader.entries > e.extHeader.max {
+		return newError("extent parse", ErrCorruptExtent, "%d entries of at most %d, there is room for %d",
+			e.extHeader.entries, e.extHeader.max, capacity)
 	}
 	var i uint16
 	for ; i < e.extHeader.entries; i++ {
@@ -96,19 +169,56 @@ func (e *Extent) parse(reader *MmapCustomReader) {
 			extentInstance.parse(reader)
 			e.extents = append(e.extents, extentInstance)
 		} else {
-			extentInstance := &ExtentInternal{}
+			extentInstance := &ExtentInternal{depth: e.extHeader.depth}
 			extentInstance.parse(reader)
 			e.extents = append(e.extents, extentInstance)
 		}
-		reader.cursorPosition += 12
 	}
+	return reader.Err()
 }
 
-func (e *Extent) enumBlocks(super SuperBlock, cb func(reader *MmapCustomReader) bool) bool {
+func (e *Extent) enumRuns(super SuperBlock, cb func(run blockRun) error) error {
 	for i := 0; i < int(e.extHeader.entries); i++ {
-		if !e.extents[i].enumBlocks(super, cb) {
-			return false
+		if err := e.extents[i].enumRuns(super, cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Extent) enumMetadataBlocks(super SuperBlock, cb func(block uint64) error) error {
+	for i := 0; i < int(e.extHeader.entries); i++ {
+		if err := e.extents[i].enumMetadataBlocks(super, cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapBlock returns the run of the leaf that maps the logical block, it binary searches every level of the tree.
+// If the block is a hole ok is false and the run spans the hole up to the next extent of the node.
+func (e *Extent) mapBlock(super SuperBlock, logical uint64) (run blockRun, ok bool, err error) {
+	entries := e.extents[:e.extHeader.entries]
+	// the last entry starting at or before the block
+	ind := sort.Search(len(entries), func(n int) bool { return entries[n].firstBlock() > logical }) - 1
+	hole := blockRun{logical: logical, length: 1}
+	if ind+1 < len(entries) {
+		hole.length = entries[ind+1].firstBlock() - logical
+	}
+	if ind < 0 {
+		return hole, false, nil
+	}
+	switch node := entries[ind].(type) {
+	case *ExtentLeaf:
+		if run = node.run(); logical < run.logical+run.length {
+			return run, true, nil
+		}
+	case *ExtentInternal:
+		child, err := node.child(super)
+		if err != nil {
+			return run, false, err
 		}
+		return child.mapBlock(super, logical)
 	}
-	return true
+	return hole, false, nil
 }
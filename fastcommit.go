@@ -0,0 +1,480 @@
+package extfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sort"
+)
+
+const (
+	EXT4_FC_TAG_ADD_RANGE = 0x1
+	EXT4_FC_TAG_DEL_RANGE = 0x2
+	EXT4_FC_TAG_CREAT     = 0x3
+	EXT4_FC_TAG_LINK      = 0x4
+	EXT4_FC_TAG_UNLINK    = 0x5
+	EXT4_FC_TAG_INODE     = 0x6
+	EXT4_FC_TAG_PAD       = 0x7
+	EXT4_FC_TAG_TAIL      = 0x8
+	EXT4_FC_TAG_HEAD      = 0x9
+	EXT4_FC_TAG_BASE_LEN  = 4 // fc_tag and fc_len
+)
+
+const EXT4_INDEX_FL = 0x1000
+
+// The offsets inside the on-disk inode the fast commit replay needs.
+const (
+	EXT4_INODE_FLAGS_OFFSET      = 0x20
+	EXT4_INODE_BLOCK_OFFSET      = 0x28
+	EXT4_INODE_GENERATION_OFFSET = 0x64
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FastCommitTag is a record of the fast commit area. Fast commits log the changes of the running
+// transaction between the full commits, so they are replayed after the transaction before Tid.
+type FastCommitTag struct {
+	Tag       uint16 // EXT4_FC_TAG_*
+	Tid       uint32 // the transaction the fast commit belongs to
+	Inode     uint32
+	Parent    uint32 // the directory of CREAT, LINK and UNLINK
+	Name      string // the entry name of CREAT, LINK and UNLINK
+	Logical   uint32 // the first file block of ADD_RANGE and DEL_RANGE
+	Length    uint32 // the number of blocks of ADD_RANGE and DEL_RANGE
+	Physical  uint64 // the first filesystem block of ADD_RANGE
+	Unwritten bool   // ADD_RANGE of an unwritten extent
+	RawInode  []byte // the on-disk inode of INODE
+}
+
+// fastCommitBlocks returns the size of the fast commit area, zero if the journal has none.
+func (j *Journal) fastCommitBlocks() uint32 {
+	if j.super.s_feature_incompat&JBD2_FEATURE_INCOMPAT_FAST_COMMIT == 0 {
+		return 0
+	}
+	if j.super.s_num_fc_blks == 0 {
+		return JOURNAL_DEFAULT_FAST_COMMIT_BLOCKS
+	}
+	return j.super.s_num_fc_blks
+}
+
+// crc32c is the raw (not inverted) crc32c ext4 uses for the fast commit tails.
+func crc32c(crc uint32, data []byte) uint32 {
+	return ^crc32.Update(^crc, castagnoliTable, data)
+}
+
+// scanFastCommits decodes the fast commit area as the kernel does: the tags are kept only if a tail
+// with the matching tid and checksum follows them. Decoding stops at the first broken fast commit.
+// Like the log, the area isn't cleared after a full commit, so the tags can belong to an old transaction.
+func (j *Journal) scanFastCommits() error {
+	j.fastCommits = nil
+	fastCommitBlocks := j.fastCommitBlocks()
+	if fastCommitBlocks == 0 {
+		return nil
+	}
+	var pending []FastCommitTag
+	var tid, crc uint32
+	started := false
+	// j.last() is one past the log, the kernel leaves it unused and starts the area after it
+	for n := j.last() + 1; n < j.last()+fastCommitBlocks; n++ {
+		data, err := j.readBlock(n)
+		if err != nil {
+			return err
+		}
+		for cur := 0; cur+EXT4_FC_TAG_BASE_LEN < len(data); {
+			tag := binary.LittleEndian.Uint16(data[cur:])
+			length := int(binary.LittleEndian.Uint16(data[cur+2:]))
+			if cur+EXT4_FC_TAG_BASE_LEN+length > len(data) {
+				return nil
+			}
+			value := data[cur+EXT4_FC_TAG_BASE_LEN : cur+EXT4_FC_TAG_BASE_LEN+length]
+			if !started && tag != EXT4_FC_TAG_HEAD {
+				return nil
+			}
+			switch tag {
+			case EXT4_FC_TAG_HEAD:
+				if length < 8 || binary.LittleEndian.Uint32(value) != 0 { // no fc_features are defined
+					return nil
+				}
+				if started && binary.LittleEndian.Uint32(value[4:]) != tid {
+					return nil
+				}
+				tid, started = binary.LittleEndian.Uint32(value[4:]), true
+			case EXT4_FC_TAG_TAIL:
+				if length < 8 {
+					return nil
+				}
+				crc = crc32c(crc, data[cur:cur+EXT4_FC_TAG_BASE_LEN+4])
+				if binary.LittleEndian.Uint32(value) != tid || binary.LittleEndian.Uint32(value[4:]) != crc {
+					return nil
+				}
+				j.fastCommits = append(j.fastCommits, pending...)
+				pending, crc = nil, 0
+			case EXT4_FC_TAG_PAD:
+			default:
+				record, ok := parseFastCommitTag(tag, value)
+				if !ok {
+					return nil
+				}
+				record.Tid = tid
+				pending = append(pending, record)
+			}
+			if tag != EXT4_FC_TAG_TAIL {
+				crc = crc32c(crc, data[cur:cur+EXT4_FC_TAG_BASE_LEN+length])
+			}
+			cur += EXT4_FC_TAG_BASE_LEN + length
+		}
+	}
+	return nil
+}
+
+func parseFastCommitTag(tag uint16, value []byte) (record FastCommitTag, ok bool) {
+	record.Tag = tag
+	switch tag {
+	case EXT4_FC_TAG_ADD_RANGE:
+		if len(value) < 16 {
+			return record, false
+		}
+		record.Inode = binary.LittleEndian.Uint32(value)
+		record.Logical = binary.LittleEndian.Uint32(value[4:])
+		length := uint32(binary.LittleEndian.Uint16(value[8:]))
+		if length > EXT_INIT_MAX_LEN {
+			length -= EXT_INIT_MAX_LEN
+			record.Unwritten = true
+		}
+		record.Length = length
+		record.Physical = uint64(binary.LittleEndian.Uint16(value[10:]))<<32 | uint64(binary.LittleEndian.Uint32(value[12:]))
+	case EXT4_FC_TAG_DEL_RANGE:
+		if len(value) < 12 {
+			return record, false
+		}
+		record.Inode = binary.LittleEndian.Uint32(value)
+		record.Logical = binary.LittleEndian.Uint32(value[4:])
+		record.Length = binary.LittleEndian.Uint32(value[8:])
+	case EXT4_FC_TAG_CREAT, EXT4_FC_TAG_LINK, EXT4_FC_TAG_UNLINK:
+		if len(value) < 8 {
+			return record, false
+		}
+		record.Parent = binary.LittleEndian.Uint32(value)
+		record.Inode = binary.LittleEndian.Uint32(value[4:])
+		record.Name = string(value[8:])
+	case EXT4_FC_TAG_INODE:
+		if len(value) < 4 {
+			return record, false
+		}
+		record.Inode = binary.LittleEndian.Uint32(value)
+		record.RawInode = append([]byte(nil), value[4:]...)
+	default:
+		return record, false
+	}
+	return record, true
+}
+
+// FastCommits returns the tags of the complete fast commits in the order they were logged.
+func (j *Journal) FastCommits() []FastCommitTag {
+	return j.fastCommits
+}
+
+// recoveryFastCommits returns the fast commit tags the kernel would replay after the recovery transactions.
+func (j *Journal) recoveryFastCommits(transactions []JournalTransaction) (tags []FastCommitTag) {
+	if j.super.s_start == 0 {
+		return nil
+	}
+	tid := j.super.s_sequence + uint32(len(transactions))
+	for _, tag := range j.fastCommits {
+		if tag.Tid == tid {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// replayFastCommits applies the tags to the overlay in the logged order, as the kernel does. An inode keeps
+// its on-disk i_block and the ranges are replayed into it, but only into an extent tree that fits into
+// the inode: deeper trees and block-mapped inodes would need new tree blocks, so the rest of the replay
+// of such an inode is skipped and reported by SkippedFastCommits. Bitmaps and counters aren't updated.
+// An entry that doesn't fit into the existing directory blocks is skipped, as it'd need a new block.
+func (e *ExtFileSystem) replayFastCommits(reader MmapCustomReader, tags []FastCommitTag) error {
+	skipped := make(map[uint32]bool)
+	for _, tag := range tags {
+		if skipped[tag.Inode] && tag.Tag != EXT4_FC_TAG_CREAT && tag.Tag != EXT4_FC_TAG_LINK && tag.Tag != EXT4_FC_TAG_UNLINK {
+			continue // the directory entries of the inode are still replayed
+		}
+		var err error
+		switch tag.Tag {
+		case EXT4_FC_TAG_INODE:
+			err = e.replayInode(&reader, tag.Inode, tag.RawInode)
+		case EXT4_FC_TAG_ADD_RANGE, EXT4_FC_TAG_DEL_RANGE:
+			err = e.replayRange(&reader, tag)
+			if failure, ok := err.(*Error); ok && errors.Is(failure, ErrUnsupportedFeature) {
+				skipped[tag.Inode] = true
+				e.skippedFastCommits = append(e.skippedFastCommits,
+					Damage{Inode: tag.Inode, Action: DamageSkipped, Err: failure})
+				err = nil
+			}
+		case EXT4_FC_TAG_CREAT, EXT4_FC_TAG_LINK:
+			err = e.addDirectoryEntry(&reader, tag.Parent, tag.Inode, tag.Name)
+		case EXT4_FC_TAG_UNLINK:
+			err = e.removeDirectoryEntry(&reader, tag.Parent, tag.Inode, tag.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SkippedFastCommits lists the inodes whose fast commit replay was refused, see Options.ReplayFastCommit.
+// They are left as the journal replay made them.
+func (e *ExtFileSystem) SkippedFastCommits() []Damage {
+	return e.skippedFastCommits
+}
+
+// overlayInode returns the overlay copy of the on-disk inode for in-place changes.
+func (e *ExtFileSystem) overlayInode(reader *MmapCustomReader, inodeNumber uint32) ([]byte, error) {
+	group := e.bgroups[(inodeNumber-1)/e.super.s_inodes_per_group]
+	offset := group.itableoffset + group.inodesize*uint64((inodeNumber-1)%e.super.s_inodes_per_group)
+	blocksize := e.super.Blocksize()
+	data, err := reader.overlayBlock(offset / blocksize)
+	if err != nil {
+		return nil, err
+	}
+	return data[offset%blocksize : offset%blocksize+group.inodesize], nil
+}
+
+// replayInode is ext4_fc_replay_inode: the logged inode is copied except for i_block, which keeps the on-disk
+// extent tree (an empty root is made if there is none) unless the inode has inline data.
+func (e *ExtFileSystem) replayInode(reader *MmapCustomReader, inodeNumber uint32, raw []byte) error {
+	if inodeNumber == 0 || inodeNumber > e.super.s_inodes_count {
+		return nil
+	}
+	inode, err := e.overlayInode(reader, inodeNumber)
+	if err != nil {
+		return err
+	}
+	copy(inode[:EXT4_INODE_BLOCK_OFFSET], raw)
+	if len(raw) > EXT4_INODE_GENERATION_OFFSET {
+		copy(inode[EXT4_INODE_GENERATION_OFFSET:], raw[EXT4_INODE_GENERATION_OFFSET:])
+	}
+	flags := binary.LittleEndian.Uint32(inode[EXT4_INODE_FLAGS_OFFSET:])
+	root := inode[EXT4_INODE_BLOCK_OFFSET:EXT4_INODE_GENERATION_OFFSET]
+	if flags&EXT4EXTENTSFL != 0 {
+		if binary.LittleEndian.Uint16(root) != EXT4_EXT_MAGIC {
+			clear(root[:12])
+			binary.LittleEndian.PutUint16(root, EXT4_EXT_MAGIC)
+			binary.LittleEndian.PutUint16(root[4:], EXT4_EXTENT_ROOT_ENTRIES)
+		}
+	} else if flags&EXT4_INLINE_DATA_FL != 0 && len(raw) >= EXT4_INODE_GENERATION_OFFSET {
+		copy(root, raw[EXT4_INODE_BLOCK_OFFSET:EXT4_INODE_GENERATION_OFFSET])
+	}
+	return nil
+}
+
+// replayRange maps the blocks of ADD_RANGE, replacing what they were mapped to, or unmaps the blocks of
+// DEL_RANGE, like ext4_fc_replay_add_range and ext4_fc_replay_del_range. Inodes the kernel can't get
+// (without links) are skipped as by the kernel.
+func (e *ExtFileSystem) replayRange(reader *MmapCustomReader, tag FastCommitTag) (err error) {
+	if tag.Inode == 0 || tag.Inode > e.super.s_inodes_count || tag.Length == 0 {
+		return nil
+	}
+	defer inodeContext(&err, tag.Inode, "")
+	inode, err := e.getInode(tag.Inode)
+	if err != nil {
+		return err
+	}
+	if inode.i_links_count == 0 {
+		return nil
+	}
+	if inode.i_flags&EXT4EXTENTSFL == 0 || inode.extent.extHeader.depth != 0 {
+		return newError("fast commit replay", ErrUnsupportedFeature, "the ranges are replayed only into extent trees kept in the inode")
+	}
+	start, end := uint64(tag.Logical), uint64(tag.Logical)+uint64(tag.Length)
+	var runs []blockRun
+	for _, node := range inode.extent.extents[:inode.extent.extHeader.entries] {
+		run := node.(*ExtentLeaf).run()
+		if run.logical < start { // the part before the range
+			head := run
+			head.length = min(run.length, start-run.logical)
+			runs = append(runs, head)
+		}
+		if runEnd := run.logical + run.length; runEnd > end { // the part after the range
+			tail := run
+			tail.logical = max(run.logical, end)
+			tail.physical += tail.logical - run.logical
+			tail.length = runEnd - tail.logical
+			runs = append(runs, tail)
+		}
+	}
+	if tag.Tag == EXT4_FC_TAG_ADD_RANGE {
+		runs = append(runs, blockRun{logical: start, physical: tag.Physical, length: uint64(tag.Length), unwritten: tag.Unwritten})
+	}
+	sort.Slice(runs, func(a, b int) bool { return runs[a].logical < runs[b].logical })
+	var merged []blockRun
+	for _, run := range runs {
+		if last := len(merged) - 1; last >= 0 && merged[last].unwritten == run.unwritten &&
+			merged[last].logical+merged[last].length == run.logical &&
+			merged[last].physical+merged[last].length == run.physical &&
+			merged[last].length+run.length <= maxExtentLen(run.unwritten) {
+			merged[last].length += run.length
+			continue
+		}
+		merged = append(merged, run)
+	}
+	if len(merged) > EXT4_EXTENT_ROOT_ENTRIES {
+		return newError("fast commit replay", ErrUnsupportedFeature, "the ranges need %d extents, the inode holds %d",
+			len(merged), EXT4_EXTENT_ROOT_ENTRIES)
+	}
+	data, err := e.overlayInode(reader, tag.Inode)
+	if err != nil {
+		return err
+	}
+	root := data[EXT4_INODE_BLOCK_OFFSET:EXT4_INODE_GENERATION_OFFSET]
+	binary.LittleEndian.PutUint16(root[2:], uint16(len(merged)))
+	binary.LittleEndian.PutUint16(root[4:], EXT4_EXTENT_ROOT_ENTRIES)
+	clear(root[12:])
+	for n, run := range merged {
+		entry := root[12+12*n:]
+		length := uint16(run.length)
+		if run.unwritten {
+			length += EXT_INIT_MAX_LEN
+		}
+		binary.LittleEndian.PutUint32(entry, uint32(run.logical))
+		binary.LittleEndian.PutUint16(entry[4:], length)
+		binary.LittleEndian.PutUint16(entry[6:], uint16(run.physical>>32))
+		binary.LittleEndian.PutUint32(entry[8:], uint32(run.physical))
+	}
+	return nil
+}
+
+// maxExtentLen returns the most blocks an extent maps, unwritten extents map one block less.
+func maxExtentLen(unwritten bool) uint64 {
+	if unwritten {
+		return EXT_UNWRITTEN_MAX_LEN
+	}
+	return EXT_INIT_MAX_LEN
+}
+
+// directoryBlocks calls cb with the overlay copies of the directory leaf blocks.
+func (e *ExtFileSystem) directoryBlocks(reader *MmapCustomReader, inodeNumber uint32, cb func([]byte) error) error {
+	inode, err := e.getInode(inodeNumber)
+	if err != nil || inode.i_mode&0xf000 != EXT4SIFDIR {
+		return err
+	}
+	indexed := inode.i_flags&EXT4_INDEX_FL != 0
+	err = inode.enumRuns(e.super, func(run blockRun) error {
+		for n := uint64(0); n < run.length; n++ {
+			if indexed && run.logical+n == 0 { // the htree root
+				continue
+			}
+			data, err := reader.overlayBlock(run.physical + n)
+			if err != nil {
+				return err
+			}
+			if err := cb(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+func directoryEntrySize(nameLen int) int {
+	return (8 + nameLen + 3) &^ 3
+}
+
+func (e *ExtFileSystem) addDirectoryEntry(reader *MmapCustomReader, parent, inodeNumber uint32, name string) error {
+	var filetype uint8
+	if e.super.s_feature_incompat&EXT4_FEATURE_INCOMPAT_FILETYPE != 0 {
+		inode, err := e.getInode(inodeNumber)
+		if err != nil {
+			return err
+		}
+		filetype = modeFiletype(inode.i_mode)
+	}
+	parentInode, err := e.getInode(parent)
+	if err != nil {
+		return err
+	}
+	indexed := parentInode.i_flags&EXT4_INDEX_FL != 0
+	size := directoryEntrySize(len(name))
+	return e.directoryBlocks(reader, parent, func(data []byte) error {
+		for pos := 0; pos+8 <= len(data); {
+			entryInode := binary.LittleEndian.Uint32(data[pos:])
+			recLen := int(binary.LittleEndian.Uint16(data[pos+4:]))
+			nameLen := int(data[pos+6])
+			if recLen == 0 || pos+recLen > len(data) {
+				return nil
+			}
+			used := 0
+			if entryInode != 0 {
+				used = directoryEntrySize(nameLen)
+			} else if data[pos+7] == 0xde || (indexed && recLen == len(data)) { // the csum tail or an htree node
+				pos += recLen
+				continue
+			}
+			if recLen-used >= size {
+				if used != 0 {
+					binary.LittleEndian.PutUint16(data[pos+4:], uint16(used))
+				}
+				entry := data[pos+used : pos+recLen]
+				binary.LittleEndian.PutUint32(entry, inodeNumber)
+				binary.LittleEndian.PutUint16(entry[4:], uint16(recLen-used))
+				entry[6] = uint8(len(name))
+				entry[7] = filetype
+				copy(entry[8:], name)
+				return errStop
+			}
+			pos += recLen
+		}
+		return nil
+	})
+}
+
+func (e *ExtFileSystem) removeDirectoryEntry(reader *MmapCustomReader, parent, inodeNumber uint32, name string) error {
+	return e.directoryBlocks(reader, parent, func(data []byte) error {
+		previous := -1
+		for pos := 0; pos+8 <= len(data); {
+			entryInode := binary.LittleEndian.Uint32(data[pos:])
+			recLen := int(binary.LittleEndian.Uint16(data[pos+4:]))
+			nameLen := int(data[pos+6])
+			if recLen == 0 || pos+8+nameLen > len(data) {
+				return nil
+			}
+			if entryInode == inodeNumber && string(data[pos+8:pos+8+nameLen]) == name {
+				if previous < 0 {
+					binary.LittleEndian.PutUint32(data[pos:], 0)
+				} else {
+					previousRecLen := binary.LittleEndian.Uint16(data[previous+4:])
+					binary.LittleEndian.PutUint16(data[previous+4:], previousRecLen+uint16(recLen))
+				}
+				return errStop
+			}
+			previous = pos
+			pos += recLen
+		}
+		return nil
+	})
+}
+
+func modeFiletype(mode uint16) uint8 {
+	switch mode & 0xf000 {
+	case EXT4SIFREG:
+		return EXT4_FT_REG_FILE
+	case EXT4SIFDIR:
+		return EXT4_FT_DIR
+	case EXT4SIFCHR:
+		return EXT4_FT_CHRDEV
+	case EXT4SIFBLK:
+		return EXT4_FT_BLKDEV
+	case EXT4SIFIFO:
+		return EXT4_FT_FIFO
+	case EXT4SIFSOCK:
+		return EXT4_FT_SOCK
+	case EXT4SIFLNK:
+		return EXT4_FT_SYMLINK
+	}
+	return EXT4_FT_UNKNOWN
+}
@@ -0,0 +1,193 @@
+package extfs
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+const (
+	EXT4_FEATURE_COMPAT_DIR_PREALLOC   = 0x1
+	EXT4_FEATURE_COMPAT_IMAGIC_INODES  = 0x2
+	EXT4_FEATURE_COMPAT_HAS_JOURNAL    = 0x4
+	EXT4_FEATURE_COMPAT_EXT_ATTR       = 0x8
+	EXT4_FEATURE_COMPAT_RESIZE_INODE   = 0x10
+	EXT4_FEATURE_COMPAT_DIR_INDEX      = 0x20
+	EXT4_FEATURE_COMPAT_LAZY_BG        = 0x40
+	EXT4_FEATURE_COMPAT_EXCLUDE_INODE  = 0x80
+	EXT4_FEATURE_COMPAT_EXCLUDE_BITMAP = 0x100
+	EXT4_FEATURE_COMPAT_SPARSE_SUPER2  = 0x200
+	EXT4_FEATURE_COMPAT_FAST_COMMIT    = 0x400
+	EXT4_FEATURE_COMPAT_STABLE_INODES  = 0x800
+	EXT4_FEATURE_COMPAT_ORPHAN_FILE    = 0x1000
+)
+
+const (
+	EXT4_FEATURE_RO_COMPAT_SPARSE_SUPER   = 0x1
+	EXT4_FEATURE_RO_COMPAT_LARGE_FILE     = 0x2
+	EXT4_FEATURE_RO_COMPAT_BTREE_DIR      = 0x4
+	EXT4_FEATURE_RO_COMPAT_HUGE_FILE      = 0x8
+	EXT4_FEATURE_RO_COMPAT_GDT_CSUM       = 0x10
+	EXT4_FEATURE_RO_COMPAT_DIR_NLINK      = 0x20
+	EXT4_FEATURE_RO_COMPAT_EXTRA_ISIZE    = 0x40
+	EXT4_FEATURE_RO_COMPAT_HAS_SNAPSHOT   = 0x80
+	EXT4_FEATURE_RO_COMPAT_QUOTA          = 0x100
+	EXT4_FEATURE_RO_COMPAT_BIGALLOC       = 0x200
+	EXT4_FEATURE_RO_COMPAT_METADATA_CSUM  = 0x400
+	EXT4_FEATURE_RO_COMPAT_REPLICA        = 0x800
+	EXT4_FEATURE_RO_COMPAT_READONLY       = 0x1000
+	EXT4_FEATURE_RO_COMPAT_PROJECT        = 0x2000
+	EXT4_FEATURE_RO_COMPAT_SHARED_BLOCKS  = 0x4000
+	EXT4_FEATURE_RO_COMPAT_VERITY         = 0x8000
+	EXT4_FEATURE_RO_COMPAT_ORPHAN_PRESENT = 0x10000
+)
+
+const (
+	EXT4_FEATURE_INCOMPAT_COMPRESSION = 0x1
+	EXT4_FEATURE_INCOMPAT_FILETYPE    = 0x2
+	EXT4_FEATURE_INCOMPAT_RECOVER     = 0x4
+	EXT4_FEATURE_INCOMPAT_JOURNAL_DEV = 0x8
+	EXT4_FEATURE_INCOMPAT_META_BG     = 0x10
+	EXT4_FEATURE_INCOMPAT_EXTENTS     = 0x40
+	EXT4_FEATURE_INCOMPAT_64BIT       = 0x80
+	EXT4_FEATURE_INCOMPAT_MMP         = 0x100
+	EXT4_FEATURE_INCOMPAT_FLEX_BG     = 0x200
+	EXT4_FEATURE_INCOMPAT_EA_INODE    = 0x400
+	EXT4_FEATURE_INCOMPAT_DIRDATA     = 0x1000
+	EXT4_FEATURE_INCOMPAT_CSUM_SEED   = 0x2000
+	EXT4_FEATURE_INCOMPAT_LARGEDIR    = 0x4000
+	EXT4_FEATURE_INCOMPAT_INLINE_DATA = 0x8000
+	EXT4_FEATURE_INCOMPAT_ENCRYPT     = 0x10000
+	EXT4_FEATURE_INCOMPAT_CASEFOLD    = 0x20000
+)
+
+// EXT4_FEATURE_INCOMPAT_SUPPORTED are the incompat features the parser handles. Directories are read linearly,
+// so the htree variants (largedir, casefold) don't matter; mmp and flex_bg don't change the layout it reads.
+const EXT4_FEATURE_INCOMPAT_SUPPORTED = EXT4_FEATURE_INCOMPAT_FILETYPE | EXT4_FEATURE_INCOMPAT_RECOVER |
+	EXT4_FEATURE_INCOMPAT_EXTENTS | EXT4_FEATURE_INCOMPAT_64BIT | EXT4_FEATURE_INCOMPAT_MMP |
+	EXT4_FEATURE_INCOMPAT_FLEX_BG | EXT4_FEATURE_INCOMPAT_EA_INODE | EXT4_FEATURE_INCOMPAT_CSUM_SEED |
+	EXT4_FEATURE_INCOMPAT_LARGEDIR | EXT4_FEATURE_INCOMPAT_CASEFOLD
+
+// the names e2fsprogs uses
+var compatFeatureNames = map[uint32]string{
+	EXT4_FEATURE_COMPAT_DIR_PREALLOC:   "dir_prealloc",
+	EXT4_FEATURE_COMPAT_IMAGIC_INODES:  "imagic_inodes",
+	EXT4_FEATURE_COMPAT_HAS_JOURNAL:    "has_journal",
+	EXT4_FEATURE_COMPAT_EXT_ATTR:       "ext_attr",
+	EXT4_FEATURE_COMPAT_RESIZE_INODE:   "resize_inode",
+	EXT4_FEATURE_COMPAT_DIR_INDEX:      "dir_index",
+	EXT4_FEATURE_COMPAT_LAZY_BG:        "lazy_bg",
+	EXT4_FEATURE_COMPAT_EXCLUDE_INODE:  "snapshot_bitmap",
+	EXT4_FEATURE_COMPAT_EXCLUDE_BITMAP: "exclude_bitmap",
+	EXT4_FEATURE_COMPAT_SPARSE_SUPER2:  "sparse_super2",
+	EXT4_FEATURE_COMPAT_FAST_COMMIT:    "fast_commit",
+	EXT4_FEATURE_COMPAT_STABLE_INODES:  "stable_inodes",
+	EXT4_FEATURE_COMPAT_ORPHAN_FILE:    "orphan_file",
+}
+
+var roCompatFeatureNames = map[uint32]string{
+	EXT4_FEATURE_RO_COMPAT_SPARSE_SUPER:   "sparse_super",
+	EXT4_FEATURE_RO_COMPAT_LARGE_FILE:     "large_file",
+	EXT4_FEATURE_RO_COMPAT_BTREE_DIR:      "btree_dir",
+	EXT4_FEATURE_RO_COMPAT_HUGE_FILE:      "huge_file",
+	EXT4_FEATURE_RO_COMPAT_GDT_CSUM:       "uninit_bg",
+	EXT4_FEATURE_RO_COMPAT_DIR_NLINK:      "dir_nlink",
+	EXT4_FEATURE_RO_COMPAT_EXTRA_ISIZE:    "extra_isize",
+	EXT4_FEATURE_RO_COMPAT_HAS_SNAPSHOT:   "snapshot",
+	EXT4_FEATURE_RO_COMPAT_QUOTA:          "quota",
+	EXT4_FEATURE_RO_COMPAT_BIGALLOC:       "bigalloc",
+	EXT4_FEATURE_RO_COMPAT_METADATA_CSUM:  "metadata_csum",
+	EXT4_FEATURE_RO_COMPAT_REPLICA:        "replica",
+	EXT4_FEATURE_RO_COMPAT_READONLY:       "read-only",
+	EXT4_FEATURE_RO_COMPAT_PROJECT:        "project",
+	EXT4_FEATURE_RO_COMPAT_SHARED_BLOCKS:  "shared_blocks",
+	EXT4_FEATURE_RO_COMPAT_VERITY:         "verity",
+	EXT4_FEATURE_RO_COMPAT_ORPHAN_PRESENT: "orphan_present",
+}
+
+var incompatFeatureNames = map[uint32]string{
+	EXT4_FEATURE_INCOMPAT_COMPRESSION: "compression",
+	EXT4_FEATURE_INCOMPAT_FILETYPE:    "filetype",
+	EXT4_FEATURE_INCOMPAT_RECOVER:     "needs_recovery",
+	EXT4_FEATURE_INCOMPAT_JOURNAL_DEV: "journal_dev",
+	EXT4_FEATURE_INCOMPAT_META_BG:     "meta_bg",
+	EXT4_FEATURE_INCOMPAT_EXTENTS:     "extent",
+	EXT4_FEATURE_INCOMPAT_64BIT:       "64bit",
+	EXT4_FEATURE_INCOMPAT_MMP:         "mmp",
+	EXT4_FEATURE_INCOMPAT_FLEX_BG:     "flex_bg",
+	EXT4_FEATURE_INCOMPAT_EA_INODE:    "ea_inode",
+	EXT4_FEATURE_INCOMPAT_DIRDATA:     "dirdata",
+	EXT4_FEATURE_INCOMPAT_CSUM_SEED:   "metadata_csum_seed",
+	EXT4_FEATURE_INCOMPAT_LARGEDIR:    "large_dir",
+	EXT4_FEATURE_INCOMPAT_INLINE_DATA: "inline_data",
+	EXT4_FEATURE_INCOMPAT_ENCRYPT:     "encrypt",
+	EXT4_FEATURE_INCOMPAT_CASEFOLD:    "casefold",
+}
+
+// FeatureSet is the set of features of the superblock.
+type FeatureSet struct {
+	Compat   uint32
+	Incompat uint32
+	ROCompat uint32
+}
+
+// featureNames names the bits of the mask in the ascending order, unknown bits are named like FEATURE_I17.
+func featureNames(mask uint32, names map[uint32]string, unknownPrefix string) (result []string) {
+	for ; mask != 0; mask &= mask - 1 {
+		bit := mask & -mask
+		if name, ok := names[bit]; ok {
+			result = append(result, name)
+		} else {
+			result = append(result, fmt.Sprintf("%s%d", unknownPrefix, bits.TrailingZeros32(bit)))
+		}
+	}
+	return
+}
+
+// Names returns the names of the features the way dumpe2fs lists them: compat, incompat and ro_compat ones.
+func (f FeatureSet) Names() (names []string) {
+	names = append(names, featureNames(f.Compat, compatFeatureNames, "FEATURE_C")...)
+	names = append(names, featureNames(f.Incompat, incompatFeatureNames, "FEATURE_I")...)
+	return append(names, featureNames(f.ROCompat, roCompatFeatureNames, "FEATURE_R")...)
+}
+
+// Has tells if the feature with the e2fsprogs name is on.
+func (f FeatureSet) Has(name string) bool {
+	for _, feature := range f.Names() {
+		if feature == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Unsupported returns the names of the incompat features the parser doesn't implement.
+func (f FeatureSet) Unsupported() []string {
+	return featureNames(f.Incompat&^EXT4_FEATURE_INCOMPAT_SUPPORTED, incompatFeatureNames, "FEATURE_I")
+}
+
+// Features returns the features of the filesystem.
+func (e *ExtFileSystem) Features() FeatureSet {
+	return FeatureSet{Compat: e.super.s_feature_compat, Incompat: e.super.s_feature_incompat,
+		ROCompat: e.super.s_feature_ro_compat}
+}
+
+// ReadFeatures returns the features of the image at targetPath. Unsupported features don't stop it.
+func ReadFeatures(targetPath string, options Options) (FeatureSet, error) {
+	options.PermissiveFeatures = true
+	fs, err := Open(targetPath, options)
+	if err != nil {
+		return FeatureSet{}, err
+	}
+	defer fs.Close()
+	return fs.Features(), nil
+}
+
+// checkFeatures refuses to parse a filesystem with incompat features that aren't implemented,
+// as it'd be misread. With Options.PermissiveFeatures it goes on, the caller finds them in Features().Unsupported().
+func (e *ExtFileSystem) checkFeatures() error {
+	unsupported := e.Features().Unsupported()
+	if len(unsupported) != 0 && !e.options.PermissiveFeatures {
+		return newError("parse", ErrUnsupportedFeature, "incompat features %v", unsupported)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package extfs
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// FileReader reads a regular file at any offset. Each read maps its offset to the blocks through the extent
+// tree or the indirect blocks, the blocks before it aren't walked.
+type FileReader struct {
+	e           *ExtFileSystem
+	inodeNumber uint32
+	path        string
+	inode       DefaultInodeTable
+	size        int64
+	offsetMutex sync.Mutex // held by Read and Seek, so they can be called concurrently
+	offset      int64
+	mutex       sync.Mutex
+	last        mappedRun // the run mapped last, sequential reads stay in it
+}
+
+// mappedRun is the result of mapBlock: the run of blocks, or the hole if mapped is false.
+type mappedRun struct {
+	blockRun
+	mapped bool
+}
+
+// OpenFile returns the reader of the regular file at the image path, the symlinks are followed as by Lookup.
+func (e *ExtFileSystem) OpenFile(path string) (reader *FileReader, err error) {
+	inodeNumber, err := e.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	defer inodeContext(&err, inodeNumber, path)
+	inode, err := e.getInode(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	if inode.i_mode&0xf000 != EXT4SIFREG {
+		return nil, newError("open", ErrNotRegular, "mode %#o", inode.i_mode)
+	}
+	return e.newFileReader(inodeNumber, path, inode, int64(inode.datasize())), nil
+}
+
+func (e *ExtFileSystem) newFileReader(inodeNumber uint32, path string, inode DefaultInodeTable, size int64) *FileReader {
+	return &FileReader{e: e, inodeNumber: inodeNumber, path: path, inode: inode, size: size}
+}
+
+// Size returns the size of the file.
+func (r *FileReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt. Holes and unwritten blocks read as zeros. It may be called concurrently.
+func (r *FileReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &Error{Op: "read", Inode: r.inodeNumber, Path: r.path, Err: errors.New("negative offset")}
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	p = p[:min(int64(want), r.size-off)]
+	r.mutex.Lock()
+	last := r.last
+	r.mutex.Unlock()
+	err = r.readAt(p, uint64(off), &last)
+	r.mutex.Lock()
+	r.last = last
+	r.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if len(p) < want {
+		return len(p), io.EOF
+	}
+	return len(p), nil
+}
+
+func (r *FileReader) readAt(p []byte, offset uint64, last *mappedRun) (err error) {
+	defer inodeContext(&err, r.inodeNumber, r.path)
+	super := r.e.super
+	blocksize := super.Blocksize()
+	for len(p) != 0 {
+		logical := offset / blocksize
+		inBlock := offset % blocksize
+		if logical < last.logical || logical >= last.logical+last.length {
+			if last.blockRun, last.mapped, err = r.inode.mapBlock(super, logical); err != nil {
+				return err
+			}
+		}
+		run := last.blockRun
+		chunk := min((run.logical+run.length-logical)*blocksize-inBlock, uint64(len(p)))
+		if !last.mapped || run.unwritten {
+			clear(p[:chunk])
+		} else {
+			physical := run.physical + logical - run.logical
+			if _, err := super.GetBlock(physical + (inBlock+chunk-1)/blocksize); err != nil { // the range check of the last block
+				return err
+			}
+			reader, err := super.GetBlock(physical)
+			if err != nil {
+				return err
+			}
+			reader.cursorPosition += int64(inBlock)
+			copy(p, reader.ReadN(int64(chunk)))
+			if err := reader.Err(); err != nil {
+				return err
+			}
+		}
+		p = p[chunk:]
+		offset += chunk
+	}
+	return nil
+}
+
+// Read implements io.Reader. Concurrent calls read consecutive parts of the file.
+func (r *FileReader) Read(p []byte) (n int, err error) {
+	r.offsetMutex.Lock()
+	defer r.offsetMutex.Unlock()
+	n, err = r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return
+}
+
+// Seek implements io.Seeker, the offset may go past the end of the file.
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	r.offsetMutex.Lock()
+	defer r.offsetMutex.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	case io.SeekStart:
+	default:
+		return 0, &Error{Op: "seek", Inode: r.inodeNumber, Path: r.path, Err: errors.New("invalid whence")}
+	}
+	if offset < 0 {
+		return 0, &Error{Op: "seek", Inode: r.inodeNumber, Path: r.path, Err: errors.New("negative position")}
+	}
+	r.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,354 @@
+package extfs
+
+import (
+	"fmt"
+	"github.com/ImSingee/mmap"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// SuperBlockInfo is the summary of the superblock in use.
+type SuperBlockInfo struct {
+	BlockSize           uint64
+	BlocksCount         uint64
+	FreeBlocksCount     uint64
+	ReservedBlocksCount uint64 // for the superuser
+	InodesCount         uint32
+	FreeInodesCount     uint32
+	FirstDataBlock      uint32
+	BlocksPerGroup      uint32
+	InodesPerGroup      uint32
+	GroupsCount         uint32
+	InodeSize           uint16
+	FirstInode          uint32 // the first non-reserved inode
+	RevLevel            uint32
+	State               uint16 // 1 is clean, 2 has errors, 4 has orphans being recovered
+	Errors              uint16 // what the kernel does on errors: 1 continue, 2 remount read-only, 3 panic
+	CreatorOS           uint32
+	UUID                [16]byte
+	VolumeName          string
+	LastMounted         string
+	Created             time.Time
+	MountTime           time.Time
+	WriteTime           time.Time
+	LastCheck           time.Time
+	MountCount          uint16
+	MaxMountCount       int16 // -1 disables the check
+	Features            FeatureSet
+	JournalInode        uint32 // zero if the journal is external or there is none
+}
+
+// Open parses the image at targetPath. The image stays mapped until Close, so the filesystem can be queried
+// many times without parsing it again.
+func Open(targetPath string, options Options) (*ExtFileSystem, error) {
+	image, err := mmap.New(mmap.NewReadOnly(targetPath))
+	if err != nil {
+		return nil, &Error{Op: "open", Err: fmt.Errorf("%w: %w", ErrIO, err)}
+	}
+	e := &ExtFileSystem{superBlockOffset: 0x400, options: options, image: image}
+	if options.ImageOffset < 0 || options.ImageOffset >= int64(image.Cap()) {
+		err = newError("open", ErrInvalidOptions, "ImageOffset %d is out of the image of %d bytes", options.ImageOffset, image.Cap())
+	} else {
+		err = e.parse(MmapCustomReader{mmapInstance: image, base: options.ImageOffset})
+	}
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Close unmaps the image and the external journal device. The filesystem and the journals it returned
+// can't be read after it.
+func (e *ExtFileSystem) Close() error {
+	var errs []error
+	for _, file := range []*mmap.Mmap{e.image, e.journalDevice} {
+		if file != nil {
+			if err := file.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return &Error{Op: "close", Err: fmt.Errorf("%w: %w", ErrIO, errs[0])}
+	}
+	return nil
+}
+
+// Info returns the summary of the superblock.
+func (e *ExtFileSystem) Info() SuperBlockInfo {
+	s := &e.super
+	timestamp := func(lo uint32, hi uint8) time.Time {
+		return time.Unix(int64(lo)|int64(hi)<<32, 0)
+	}
+	info := SuperBlockInfo{
+		BlockSize:           s.Blocksize(),
+		BlocksCount:         s.BlocksCount(),
+		FreeBlocksCount:     uint64(s.s_free_blocks_count),
+		ReservedBlocksCount: uint64(s.s_r_blocks_count),
+		InodesCount:         s.s_inodes_count,
+		FreeInodesCount:     s.s_free_inodes_count,
+		FirstDataBlock:      s.s_first_data_block,
+		BlocksPerGroup:      s.s_blocks_per_group,
+		InodesPerGroup:      s.s_inodes_per_group,
+		GroupsCount:         s.Ngroups(),
+		InodeSize:           s.s_inode_size,
+		FirstInode:          s.s_first_ino,
+		RevLevel:            s.s_rev_level,
+		State:               s.s_state,
+		Errors:              s.s_errors,
+		CreatorOS:           s.s_creator_os,
+		VolumeName:          strings.TrimRight(string(s.s_volume_name), "\x00"),
+		LastMounted:         strings.TrimRight(string(s.s_last_mounted), "\x00"),
+		Created:             timestamp(s.s_mkfs_time, s.s_mkfs_time_hi),
+		MountTime:           timestamp(s.s_mtime, s.s_mtime_hi),
+		WriteTime:           timestamp(s.s_wtime, s.s_wtime_hi),
+		LastCheck:           timestamp(s.s_lastcheck, s.s_lastcheck_hi),
+		MountCount:          s.s_mnt_count,
+		MaxMountCount:       int16(s.s_max_mnt_count),
+		Features:            e.Features(),
+		JournalInode:        s.s_journal_inum,
+	}
+	if s.s_feature_incompat&EXT4_FEATURE_INCOMPAT_64BIT != 0 {
+		info.FreeBlocksCount |= uint64(s.s_free_blocks_count_hi) << 32
+		info.ReservedBlocksCount |= uint64(s.s_r_blocks_count_hi) << 32
+	}
+	copy(info.UUID[:], s.s_uuid)
+	return info
+}
+
+// Lookup returns the inode number of the image path, like /etc/passwd. The symlinks are followed, the absolute
+// ones from the image root; ".." never leaves the root. Following more than Options.MaxSymlinks fails with
+// ErrSymlinkLoop.
+func (e *ExtFileSystem) Lookup(path string) (inodeNumber uint32, err error) {
+	return e.lookup(path)
+}
+
+func (e *ExtFileSystem) lookup(path string) (uint32, error) {
+	return e.walkPath(path, true, true)
+}
+
+// Stat returns the inode at the image path, the symlinks are followed as by Lookup.
+func (e *ExtFileSystem) Stat(path string) (inode *Inode, err error) {
+	inodeNumber, err := e.walkPath(path, true, true)
+	if err != nil {
+		return nil, err
+	}
+	return e.stat(inodeNumber, path)
+}
+
+// Lstat is Stat that doesn't follow the symlink the path ends with.
+func (e *ExtFileSystem) Lstat(path string) (inode *Inode, err error) {
+	inodeNumber, err := e.walkPath(path, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return e.stat(inodeNumber, path)
+}
+
+func (e *ExtFileSystem) stat(inodeNumber uint32, path string) (details *Inode, err error) {
+	defer inodeContext(&err, inodeNumber, path)
+	inode, err := e.getInode(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	return e.newInode(inodeNumber, inode)
+}
+
+// Inode decodes the inode whether it's allocated or not. It fails with ErrInodeOutOfRange for numbers
+// beyond s_inodes_count.
+func (e *ExtFileSystem) Inode(inodeNumber uint32) (inode *Inode, err error) {
+	return e.stat(inodeNumber, "")
+}
+
+// EnumInodes calls the callback for every allocated inode in the number order, as the inode bitmaps tell.
+// With unallocated it also visits the free inodes that aren't zeroed, like the ones of deleted files, skipping
+// those that can't be decoded. Groups with INODE_UNINIT are skipped, their tables may be uninitialized.
+// It stops when the callback returns false.
+func (e *ExtFileSystem) EnumInodes(unallocated bool, callback func(inode *Inode) bool) (err error) {
+	perGroup := e.super.s_inodes_per_group
+	for group, desc := range e.bgdescs {
+		if desc.getFlags()&EXT4_BG_INODE_UNINIT != 0 {
+			continue
+		}
+		reader, err := e.super.GetBlock(desc.getInodeBitmapBlock())
+		if err != nil {
+			return err
+		}
+		bitmap := reader.ReadN(int64(perGroup+7) / 8)
+		if err := reader.Err(); err != nil {
+			return err
+		}
+		for local := uint32(0); local < perGroup; local++ {
+			inodeNumber := uint32(group)*perGroup + local + 1
+			if inodeNumber > e.super.s_inodes_count {
+				return nil
+			}
+			var details *Inode
+			if bitmap[local/8]&(1<<(local%8)) != 0 {
+				if details, err = e.stat(inodeNumber, ""); err != nil {
+					return err
+				}
+			} else if unallocated {
+				if inode, err := e.getInode(inodeNumber); err == nil && !inode.emptyFlag {
+					if decoded, err := e.newInode(inodeNumber, inode); err == nil {
+						details = decoded
+					}
+				}
+			}
+			if details != nil && !callback(details) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// defaultMaxSymlinks bounds the symlinks followed by a single lookup, as MAXSYMLINKS does in Linux.
+const defaultMaxSymlinks = 40
+
+// walkPath looks the image path up. With followSymlinks the symlinks met on the way are followed, the last
+// component too if followLast is set. Absolute targets start from the image root and ".." never leaves it.
+func (e *ExtFileSystem) walkPath(path string, followSymlinks bool, followLast bool) (uint32, error) {
+	inodeNumber := uint32(ROOTDIRINODE)
+	var walked []string
+	names := strings.Split(path, "/")
+	links, maxSymlinks := 0, e.options.MaxSymlinks
+	if maxSymlinks == 0 {
+		maxSymlinks = defaultMaxSymlinks
+	}
+	for len(names) != 0 {
+		name := names[0]
+		names = names[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		directory, err := e.getInode(inodeNumber)
+		if err != nil {
+			return 0, err
+		}
+		if directory.i_mode&0xf000 != EXT4SIFDIR {
+			return 0, &Error{Op: "lookup", Inode: inodeNumber, Path: "/" + strings.Join(walked, "/"), Err: ErrNotDir}
+		}
+		if name == ".." {
+			walked = walked[:max(len(walked)-1, 0)]
+		} else {
+			walked = append(walked, name)
+		}
+		entry, ok, err := e.findEntry(inodeNumber, name)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, &Error{Op: "lookup", Path: "/" + strings.Join(walked, "/"), Err: fs.ErrNotExist}
+		}
+		inode, err := e.getInode(entry.inode)
+		if err != nil {
+			return 0, err
+		}
+		if followSymlinks && inode.i_mode&0xf000 == EXT4SIFLNK && (followLast || len(names) != 0) {
+			linkPath := "/" + strings.Join(walked, "/")
+			if links++; links > maxSymlinks {
+				return 0, &Error{Op: "lookup", Inode: entry.inode, Path: linkPath, Err: ErrSymlinkLoop}
+			}
+			target, err := e.readSymlink(entry.inode, linkPath)
+			if err != nil {
+				return 0, err
+			}
+			if target == "" {
+				return 0, &Error{Op: "lookup", Inode: entry.inode, Path: linkPath, Err: fs.ErrNotExist}
+			}
+			walked = walked[:len(walked)-1]
+			if strings.HasPrefix(target, "/") {
+				inodeNumber = ROOTDIRINODE
+				walked = nil
+			}
+			names = append(strings.Split(target, "/"), names...)
+			continue
+		}
+		inodeNumber = entry.inode
+	}
+	return inodeNumber, nil
+}
+
+// readSymlink returns the target of the symlink inode.
+func (e *ExtFileSystem) readSymlink(inodeNumber uint32, path string) (target string, err error) {
+	defer inodeContext(&err, inodeNumber, path)
+	inode, err := e.getInode(inodeNumber)
+	if err != nil {
+		return "", err
+	}
+	return e.readLink(inode)
+}
+
+// ReadFile returns the content of the regular file at the image path, the symlinks are followed as by Lookup.
+func (e *ExtFileSystem) ReadFile(path string) (data []byte, err error) {
+	inodeNumber, err := e.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.readFile(inodeNumber, path)
+}
+
+func (e *ExtFileSystem) readFile(inodeNumber uint32, path string) (data []byte, err error) {
+	defer inodeContext(&err, inodeNumber, path)
+	inode, err := e.getInode(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	if inode.i_mode&0xf000 != EXT4SIFREG {
+		return nil, newError("read", ErrNotRegular, "mode %#o", inode.i_mode)
+	}
+	return e.readInodeData(inode, inode.datasize())
+}
+
+// findEntry looks the name up in the directory.
+func (e *ExtFileSystem) findEntry(directory uint32, name string) (found DirectoryEntry, ok bool, err error) {
+	defer inodeContext(&err, directory, "")
+	inode, err := e.getInode(directory)
+	if err != nil {
+		return found, false, err
+	}
+	err = inode.enumBlocks(e.super, func(reader *MmapCustomReader) error {
+		return e.enumDirectoryBlock(reader, func(entry DirectoryEntry) error {
+			if entry.inode != 0 && entry.name == name {
+				found, ok = entry, true
+				return errStop
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errStop {
+		return found, false, err
+	}
+	return found, ok, nil
+}
+
+// enumDirectoryBlock calls the callback for every entry of the directory block at the reader, unused ones included.
+func (e *ExtFileSystem) enumDirectoryBlock(reader *MmapCustomReader, callback func(DirectoryEntry) error) error {
+	blocksize := int64(e.super.Blocksize())
+	start := reader.cursorPosition
+	currentReader := *reader
+	for currentReader.cursorPosition < start+blocksize {
+		var entry DirectoryEntry
+		readerForDirectoryEntryParser := currentReader
+		entry.parse(&readerForDirectoryEntryParser)
+		if err := readerForDirectoryEntryParser.Err(); err != nil {
+			return err
+		}
+		recLen := int64(entry.rec_len)
+		if recLen == 0 {
+			break
+		}
+		if recLen < 8 || recLen < 8+int64(entry.name_len) || currentReader.cursorPosition+recLen > start+blocksize {
+			return newError("directory parse", ErrCorrupt, "block %d: invalid entry length %d at offset %d",
+				start/blocksize, recLen, currentReader.cursorPosition-start)
+		}
+		currentReader.cursorPosition += recLen
+		if err := callback(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
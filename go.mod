@@ -5,6 +5,5 @@ go 1.22.7
 require (
 	github.com/ImSingee/mmap v1.3.0
 	github.com/google/go-cmp v0.6.0
+	golang.org/x/sys v0.0.0-20210910150752-751e447fb3d0
 )
-
-require golang.org/x/sys v0.0.0-20210910150752-751e447fb3d0 // indirect
@@ -1,5 +1,11 @@
 package extfs
 
+import (
+	"encoding/binary"
+	"io/fs"
+	"time"
+)
+
 type DefaultInodeTable struct {
 	i_mode        uint16
 	i_uid         uint16
@@ -21,11 +27,23 @@ type DefaultInodeTable struct {
 	i_dir_acl     uint32
 	i_faddr       uint32
 	i_osd2        []uint8
-	emptyFlag     bool
+	// the fields below exist only when the inode size is greater than 128 and i_extra_isize covers them
+	i_extra_isize  uint16
+	i_checksum_hi  uint16
+	i_ctime_extra  uint32
+	i_mtime_extra  uint32
+	i_atime_extra  uint32
+	i_crtime       uint32
+	i_crtime_extra uint32
+	i_version_hi   uint32
+	i_projid       uint32
+	inlineXattrs   []byte // the in-inode extended attribute area, see xattr.go
+	emptyFlag      bool
 }
 
-func (i *DefaultInodeTable) parse(reader *MmapCustomReader) {
+func (i *DefaultInodeTable) parse(reader *MmapCustomReader, inodeSize uint64) error {
 	i.setEmptyFlag(*reader)
+	inodePosition := reader.cursorPosition
 	i.i_mode = reader.Read16le(2)
 	i.i_uid = reader.Read16le(2)
 	i.i_size = reader.Read32le(4)
@@ -38,20 +56,77 @@ func (i *DefaultInodeTable) parse(reader *MmapCustomReader) {
 	i.i_blocks = reader.Read32le(4)
 	i.i_flags = reader.Read32le(4)
 	i.i_osd1 = reader.Read32le(4)
+	iblockPosition := reader.cursorPosition
+	for ind := 0; ind < 15; ind++ {
+		i.i_block[ind] = reader.Read32le(4)
+	}
 	if i.isSymlink() {
+		reader.SetCursorValue(iblockPosition)
 		i.symlink = string(reader.ReadN(60))
 	} else if (i.i_flags & EXT4EXTENTSFL) != 0 {
-		i.extent.parse(reader)
-	} else {
-		for ind := 0; ind < 15; ind++ {
-			i.i_block[ind] = reader.Read32le(4)
+		reader.SetCursorValue(iblockPosition)
+		if err := i.extent.parse(reader, EXT4_EXTENT_ROOT_ENTRIES); err != nil {
+			return err
 		}
 	}
+	reader.SetCursorValue(iblockPosition + 60)
 	i.i_generation = reader.Read32le(4)
 	i.i_file_acl = reader.Read32le(4)
 	i.i_dir_acl = reader.Read32le(4)
 	i.i_faddr = reader.Read32le(4)
 	i.i_osd2 = reader.ReadN(12)
+	if inodeSize > 128 {
+		i.parseExtraFields(reader, inodePosition, inodeSize)
+	}
+	return reader.Err()
+}
+
+func (i *DefaultInodeTable) parseExtraFields(reader *MmapCustomReader, inodePosition int64, inodeSize uint64) {
+	i.i_extra_isize = reader.Read16le(2)
+	if 128+uint64(i.i_extra_isize) > inodeSize {
+		i.i_extra_isize = 0
+		return
+	}
+	extraFields := []*uint32{&i.i_ctime_extra, &i.i_mtime_extra, &i.i_atime_extra, &i.i_crtime,
+		&i.i_crtime_extra, &i.i_version_hi, &i.i_projid}
+	if i.i_extra_isize >= 4 {
+		i.i_checksum_hi = reader.Read16le(2)
+	}
+	for ind, field := range extraFields {
+		if uint16(ind+2)*4 > i.i_extra_isize {
+			break
+		}
+		*field = reader.Read32le(4)
+	}
+	reader.SetCursorValue(inodePosition + 128 + int64(i.i_extra_isize))
+	i.inlineXattrs = reader.ReadN(int64(inodeSize) - 128 - int64(i.i_extra_isize))
+}
+
+// inodeTime decodes a timestamp. The low 2 bits of the extra field extend the seconds beyond 2038,
+// the rest are nanoseconds.
+func inodeTime(seconds uint32, extra uint32) time.Time {
+	return time.Unix(int64(int32(seconds))+int64(extra&3)<<32, int64(extra>>2))
+}
+
+func (i *DefaultInodeTable) atime() time.Time {
+	return inodeTime(i.i_atime, i.i_atime_extra)
+}
+
+func (i *DefaultInodeTable) mtime() time.Time {
+	return inodeTime(i.i_mtime, i.i_mtime_extra)
+}
+
+func (i *DefaultInodeTable) ctime() time.Time {
+	return inodeTime(i.i_ctime, i.i_ctime_extra)
+}
+
+func (i *DefaultInodeTable) crtime() time.Time {
+	return inodeTime(i.i_crtime, i.i_crtime_extra)
+}
+
+// fileACL returns the number of the block with extended attributes, l_i_file_acl_high is kept in osd2.
+func (i *DefaultInodeTable) fileACL() uint64 {
+	return uint64(i.i_osd2[3])<<40 | uint64(i.i_osd2[2])<<32 | uint64(i.i_file_acl)
 }
 
 func (i *DefaultInodeTable) setEmptyFlag(reader MmapCustomReader) {
@@ -69,89 +144,216 @@ func (i *DefaultInodeTable) isSymlink() bool {
 	return (i.i_mode&0xf000) == EXT4SIFLNK && i.i_size < 60
 }
 
-func (i *DefaultInodeTable) enumBlocks(super SuperBlock, callback func(reader *MmapCustomReader) bool) bool {
-	if i.isSymlink() {
+// uid returns the full owner id, the high 16 bits are kept in osd2 (l_i_uid_high).
+func (i *DefaultInodeTable) uid() uint32 {
+	return uint32(i.i_osd2[5])<<24 | uint32(i.i_osd2[4])<<16 | uint32(i.i_uid)
+}
 
-	} else if i.i_flags&EXT4EXTENTSFL != 0 {
-		return i.enumExtents(super, callback)
+// gid returns the full group id, the high 16 bits are kept in osd2 (l_i_gid_high).
+func (i *DefaultInodeTable) gid() uint32 {
+	return uint32(i.i_osd2[7])<<24 | uint32(i.i_osd2[6])<<16 | uint32(i.i_gid)
+}
+
+func (i *DefaultInodeTable) isDevice() bool {
+	switch i.i_mode & 0xf000 {
+	case EXT4SIFCHR, EXT4SIFBLK:
+		return true
 	}
-	var currentBytes uint64
-	for ind := 0; ind < 12 && currentBytes < uint64(i.i_size); ind++ {
-		if i.i_block[ind] != 0 {
-			if !callback(super.GetBlock(uint64(i.i_block[ind]))) {
-				return false
+	return false
+}
+
+// deviceNumber decodes the major/minor numbers of a device inode. The old encoding keeps them in i_block[0],
+// the new one (used when the numbers don't fit into a byte) in i_block[1].
+func (i *DefaultInodeTable) deviceNumber() (major uint32, minor uint32) {
+	if i.i_block[0] != 0 {
+		major = (i.i_block[0] >> 8) & 0xff
+		minor = i.i_block[0] & 0xff
+	} else {
+		major = (i.i_block[1] & 0xfff00) >> 8
+		minor = (i.i_block[1] & 0xff) | ((i.i_block[1] >> 12) & 0xfff00)
+	}
+	return
+}
+
+// blockRun is a run of contiguous blocks of an inode.
+type blockRun struct {
+	logical   uint64 // the first block number inside the file
+	physical  uint64 // the first block number on the disk
+	length    uint64
+	unwritten bool  // preallocated blocks, they read as zeros
+	damage    error // the blocks from logical on are mapped by physical, an index or indirect block that can't be read
+}
+
+// enumBlocks calls the callback for every block with data in the logical order. Holes and unwritten extents are skipped.
+// Like all the walkers, it stops at the first error the callback returns and returns it.
+func (i *DefaultInodeTable) enumBlocks(super SuperBlock, callback func(reader *MmapCustomReader) error) error {
+	return i.enumRuns(super, func(run blockRun) error {
+		if run.unwritten {
+			return nil
+		}
+		for n := uint64(0); n < run.length; n++ {
+			reader, err := super.GetBlock(run.physical + n)
+			if err != nil {
+				return err
+			}
+			if err := callback(reader); err != nil {
+				return err
 			}
-			currentBytes += super.Blocksize()
 		}
-	}
-	if (i.i_block[12]) != 0 {
-		if !i.enum12Block(super, currentBytes, super.GetBlock(uint64(i.i_block[12])), callback) {
-			return false
+		return nil
+	})
+}
+
+// enumRuns calls the callback for every mapped run of blocks in the logical order. It fails on a damaged mapping.
+func (i *DefaultInodeTable) enumRuns(super SuperBlock, callback func(run blockRun) error) error {
+	return i.enumRunsWithDamage(super, func(run blockRun) error {
+		if run.damage != nil {
+			return run.damage
 		}
+		return callback(run)
+	})
+}
+
+// enumRunsWithDamage is enumRuns that goes past the index and indirect blocks it can't read. Each of them is
+// passed to the callback as a run with the damage set, its length is unknown for extent indexes.
+func (i *DefaultInodeTable) enumRunsWithDamage(super SuperBlock, callback func(run blockRun) error) error {
+	if i.isSymlink() { // the target is kept in i_block itself
+		return nil
+	} else if i.i_flags&EXT4EXTENTSFL != 0 {
+		return i.extent.enumRuns(super, callback)
 	}
-	if (i.i_block[13]) != 0 {
-		if !i.enum13Block(super, currentBytes, super.GetBlock(uint64(i.i_block[13])), callback) {
-			return false
+	nblocks := (i.datasize() + super.Blocksize() - 1) / super.Blocksize()
+	var logical uint64
+	for ind := 0; ind < 12 && logical < nblocks; ind++ {
+		if i.i_block[ind] != 0 {
+			if err := callback(blockRun{logical: logical, physical: uint64(i.i_block[ind]), length: 1}); err != nil {
+				return err
+			}
 		}
+		logical++
 	}
-	if (i.i_block[14]) != 0 {
-		if !i.enum14Block(super, currentBytes, super.GetBlock(uint64(i.i_block[14])), callback) {
-			return false
+	for depth := 1; depth <= 3 && logical < nblocks; depth++ {
+		if err := i.enumIndirectBlock(super, i.i_block[11+depth], depth, &logical, nblocks, callback); err != nil {
+			return err
 		}
 	}
-	return true
+	return nil
 }
 
-func (i *DefaultInodeTable) enum12Block(super SuperBlock, bytes uint64, reader *MmapCustomReader, callback func(reader *MmapCustomReader) bool) bool {
-	currentReader := *reader
-	readerInEnd := *reader
-	readerInEnd.SetCursorValue(int64(super.Blocksize()))
-	for currentReader.cursorPosition < readerInEnd.cursorPosition && bytes < uint64(i.i_size) {
-		currentReader.cursorPosition++
-		blockNumber := currentReader.cursorPosition
-		if blockNumber != 0 {
-			if !callback(super.GetBlock(uint64(blockNumber))) {
-				return false
+// enumIndirectBlock walks an indirect (depth 1), double-indirect (2) or triple-indirect (3) block.
+func (i *DefaultInodeTable) enumIndirectBlock(super SuperBlock, blockNumber uint32, depth int, logical *uint64,
+	nblocks uint64, callback func(run blockRun) error) error {
+	pointers := super.Blocksize() / 4
+	span := uint64(1)
+	for d := 0; d < depth; d++ {
+		span *= pointers
+	}
+	if blockNumber == 0 { // the whole subtree is a hole
+		*logical += span
+		return nil
+	}
+	buf, err := super.readBlock(uint64(blockNumber))
+	if err != nil {
+		run := blockRun{logical: *logical, physical: uint64(blockNumber), length: min(span, nblocks-*logical), damage: err}
+		*logical += span
+		return callback(run)
+	}
+	for ind := uint64(0); ind < pointers && *logical < nblocks; ind++ {
+		pointer := binary.LittleEndian.Uint32(buf[ind*4:])
+		if depth > 1 {
+			if err := i.enumIndirectBlock(super, pointer, depth-1, logical, nblocks, callback); err != nil {
+				return err
+			}
+			continue
+		}
+		if pointer != 0 {
+			if err := callback(blockRun{logical: *logical, physical: uint64(pointer), length: 1}); err != nil {
+				return err
 			}
 		}
-		bytes += super.Blocksize()
+		*logical++
 	}
-	return true
+	return nil
 }
 
-func (i *DefaultInodeTable) enum13Block(super SuperBlock, bytes uint64, reader *MmapCustomReader, callback func(reader *MmapCustomReader) bool) bool {
-	currentReader := *reader
-	readerInEnd := *reader
-	readerInEnd.SetCursorValue(int64(super.Blocksize()))
-	for currentReader.cursorPosition < readerInEnd.cursorPosition && bytes < uint64(i.i_size) {
-		currentReader.cursorPosition++
-		blockNumber := currentReader.cursorPosition
-		if !i.enum12Block(super, bytes, super.GetBlock(uint64(blockNumber)), callback) {
-			return false
+// mapBlock returns the run that maps the logical block without walking the blocks before it: the extent tree
+// is binary searched, the indirect blocks are indexed directly. If the block is a hole ok is false and the run
+// spans the hole, or the block alone when its end isn't known.
+func (i *DefaultInodeTable) mapBlock(super SuperBlock, logical uint64) (run blockRun, ok bool, err error) {
+	if i.isSymlink() {
+		return blockRun{logical: logical, length: 1}, false, nil
+	} else if i.i_flags&EXT4EXTENTSFL != 0 {
+		return i.extent.mapBlock(super, logical)
+	}
+	if logical < 12 {
+		return blockRun{logical: logical, physical: uint64(i.i_block[logical]), length: 1}, i.i_block[logical] != 0, nil
+	}
+	pointers := super.Blocksize() / 4
+	index := logical - 12
+	span := uint64(1)
+	for depth := 1; depth <= 3; depth++ {
+		span *= pointers
+		if index >= span {
+			index -= span
+			continue
+		}
+		pointer := i.i_block[11+depth]
+		for ; depth > 0 && pointer != 0; depth-- {
+			span /= pointers
+			buf, err := super.readBlock(uint64(pointer))
+			if err != nil {
+				return run, false, err
+			}
+			pointer = binary.LittleEndian.Uint32(buf[index/span*4:])
+			index %= span
 		}
+		return blockRun{logical: logical, physical: uint64(pointer), length: 1}, pointer != 0, nil
 	}
-	return true
+	return blockRun{logical: logical, length: 1}, false, nil
 }
 
-func (i *DefaultInodeTable) enum14Block(super SuperBlock, bytes uint64, reader *MmapCustomReader, callback func(reader *MmapCustomReader) bool) bool {
-	currentReader := *reader
-	readerInEnd := *reader
-	readerInEnd.SetCursorValue(int64(super.Blocksize()))
-	for currentReader.cursorPosition < readerInEnd.cursorPosition && bytes < uint64(i.i_size) {
-		currentReader.cursorPosition++
-		blockNumber := currentReader.cursorPosition
-		if !i.enum13Block(super, bytes, super.GetBlock(uint64(blockNumber)), callback) {
-			return false
+// enumMetadataBlocks calls the callback for every block that maps the data: indirect blocks and extent tree nodes.
+func (i *DefaultInodeTable) enumMetadataBlocks(super SuperBlock, callback func(block uint64) error) error {
+	if i.isSymlink() {
+		return nil
+	} else if i.i_flags&EXT4EXTENTSFL != 0 {
+		return i.extent.enumMetadataBlocks(super, callback)
+	}
+	for depth := 1; depth <= 3; depth++ {
+		if err := i.enumIndirectMetadata(super, i.i_block[11+depth], depth, callback); err != nil {
+			return err
 		}
 	}
-	return true
+	return nil
 }
 
-func (i *DefaultInodeTable) enumExtents(super SuperBlock, callback func(reader *MmapCustomReader) bool) bool {
-	return i.extent.enumBlocks(super, callback)
+func (i *DefaultInodeTable) enumIndirectMetadata(super SuperBlock, blockNumber uint32, depth int,
+	callback func(block uint64) error) error {
+	if blockNumber == 0 {
+		return nil
+	}
+	if err := callback(uint64(blockNumber)); err != nil {
+		return err
+	}
+	if depth == 1 {
+		return nil
+	}
+	buf, err := super.readBlock(uint64(blockNumber))
+	if err != nil {
+		return err
+	}
+	for ind := uint64(0); ind < super.Blocksize()/4; ind++ {
+		if err := i.enumIndirectMetadata(super, binary.LittleEndian.Uint32(buf[ind*4:]), depth-1, callback); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (i *DefaultInodeTable) datasize() uint64 {
+	if i.i_mode&0xf000 == EXT4SIFREG { // i_dir_acl is i_size_high for regular files
+		return uint64(i.i_dir_acl)<<32 | uint64(i.i_size)
+	}
 	return uint64(i.i_size)
 }
 
@@ -170,3 +372,102 @@ func (d *DirectoryEntry) parse(reader *MmapCustomReader) {
 	d.filetype = reader.Read8(1)
 	d.name = string(reader.ReadN(int64(d.name_len)))
 }
+
+// Inode is the decoded inode, FileInfo.Sys of the io/fs view returns it.
+type Inode struct {
+	Number     uint32
+	Allocated  bool   // set in the inode bitmap
+	Mode       uint16 // raw i_mode: the file type, setuid/setgid/sticky and permission bits
+	Uid        uint32
+	Gid        uint32
+	Links      uint16
+	Size       uint64
+	DiskUsage  uint64 // the bytes of the blocks the inode is charged for
+	Major      uint32 // the device number of block and character devices
+	Minor      uint32
+	Atime      time.Time
+	Mtime      time.Time
+	Ctime      time.Time
+	Crtime     time.Time // zero if the inode has no creation time
+	Dtime      uint32    // the deletion time, or the next inode of the orphan list
+	Flags      uint32
+	Generation uint32
+	ProjectID  uint32
+	FileACL    uint64 // the extended attribute block
+	Symlink    string
+	Xattrs     map[string][]byte
+}
+
+// FileMode converts i_mode to fs.FileMode.
+func (i *Inode) FileMode() fs.FileMode {
+	mode := fs.FileMode(i.Mode & 0777)
+	switch i.Mode & 0xf000 {
+	case EXT4SIFDIR:
+		mode |= fs.ModeDir
+	case EXT4SIFLNK:
+		mode |= fs.ModeSymlink
+	case EXT4SIFBLK:
+		mode |= fs.ModeDevice
+	case EXT4SIFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case EXT4SIFIFO:
+		mode |= fs.ModeNamedPipe
+	case EXT4SIFSOCK:
+		mode |= fs.ModeSocket
+	}
+	if i.Mode&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if i.Mode&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if i.Mode&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+func (e *ExtFileSystem) newInode(inodeNumber uint32, inode DefaultInodeTable) (*Inode, error) {
+	allocated, err := e.inodeAllocated(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	xattrs, err := e.getXattrs(inode)
+	if err != nil {
+		return nil, err
+	}
+	details := &Inode{
+		Number:     inodeNumber,
+		Allocated:  allocated,
+		Mode:       inode.i_mode,
+		Uid:        inode.uid(),
+		Gid:        inode.gid(),
+		Links:      inode.i_links_count,
+		Size:       inode.datasize(),
+		DiskUsage:  e.inodeBytes(inode),
+		Atime:      inode.atime(),
+		Mtime:      inode.mtime(),
+		Ctime:      inode.ctime(),
+		Dtime:      inode.i_dtime,
+		Flags:      inode.i_flags,
+		Generation: inode.i_generation,
+		ProjectID:  inode.i_projid,
+		FileACL:    inode.fileACL(),
+		Xattrs:     xattrs,
+	}
+	if inode.i_crtime != 0 || inode.i_crtime_extra != 0 {
+		details.Crtime = inode.crtime()
+	}
+	if inode.isDevice() {
+		details.Major, details.Minor = inode.deviceNumber()
+	}
+	if inode.i_mode&0xf000 == EXT4SIFLNK {
+		if details.Symlink, err = e.readLink(inode); err != nil {
+			return nil, err
+		}
+	}
+	if len(details.Xattrs) == 0 {
+		details.Xattrs = nil
+	}
+	return details, nil
+}
@@ -0,0 +1,337 @@
+package extfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// FS is the io/fs view of the filesystem, see ExtFileSystem.FS.
+type FS struct {
+	e *ExtFileSystem
+}
+
+// FS returns the filesystem as an fs.FS. The names are the unrooted slash-separated paths of io/fs.
+// Open, Stat and ReadFile follow symlinks, Lstat and ReadLink don't. It implements fs.ReadDirFS,
+// fs.ReadFileFS, fs.StatFS and fs.ReadLinkFS; FileInfo.Sys returns *Inode.
+func (e *ExtFileSystem) FS() *FS {
+	return &FS{e: e}
+}
+
+// run validates the name and turns the failure of the work into *fs.PathError.
+func (f *FS) run(op string, name string, work func() error) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := work(); err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	var opened fs.File
+	err := f.run("open", name, func() error {
+		inodeNumber, err := f.e.walkPath(name, true, true)
+		if err != nil {
+			return err
+		}
+		info, err := f.stat(inodeNumber, name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			entries, err := f.readDir(inodeNumber, name)
+			if err != nil {
+				return err
+			}
+			opened = &dir{info: info, entries: entries}
+			return nil
+		}
+		inode, err := f.e.getInode(inodeNumber)
+		if err != nil {
+			return err
+		}
+		size := int64(0)
+		if inode.i_mode&0xf000 == EXT4SIFREG {
+			size = info.Size()
+		}
+		opened = &file{name: name, info: info, reader: f.e.newFileReader(inodeNumber, imagePath(name), inode, size)}
+		return nil
+	})
+	return opened, err
+}
+
+func (f *FS) Stat(name string) (info fs.FileInfo, err error) {
+	err = f.run("stat", name, func() error {
+		inodeNumber, err := f.e.walkPath(name, true, true)
+		if err != nil {
+			return err
+		}
+		info, err = f.stat(inodeNumber, name)
+		return err
+	})
+	return
+}
+
+// Lstat is Stat that doesn't follow the last symlink.
+func (f *FS) Lstat(name string) (info fs.FileInfo, err error) {
+	err = f.run("lstat", name, func() error {
+		inodeNumber, err := f.e.walkPath(name, true, false)
+		if err != nil {
+			return err
+		}
+		info, err = f.stat(inodeNumber, name)
+		return err
+	})
+	return
+}
+
+// ReadLink returns the target of the symlink.
+func (f *FS) ReadLink(name string) (target string, err error) {
+	err = f.run("readlink", name, func() error {
+		inodeNumber, err := f.e.walkPath(name, true, false)
+		if err != nil {
+			return err
+		}
+		inode, err := f.e.getInode(inodeNumber)
+		if err != nil {
+			return err
+		}
+		if inode.i_mode&0xf000 != EXT4SIFLNK {
+			return &Error{Op: "readlink", Inode: inodeNumber, Path: imagePath(name), Err: fs.ErrInvalid}
+		}
+		target, err = f.e.readSymlink(inodeNumber, imagePath(name))
+		return err
+	})
+	return
+}
+
+// ReadDir returns the entries of the directory sorted by name, without "." and "..".
+func (f *FS) ReadDir(name string) (entries []fs.DirEntry, err error) {
+	err = f.run("readdir", name, func() error {
+		inodeNumber, err := f.e.walkPath(name, true, true)
+		if err != nil {
+			return err
+		}
+		inode, err := f.e.getInode(inodeNumber)
+		if err != nil {
+			return err
+		}
+		if inode.i_mode&0xf000 != EXT4SIFDIR {
+			return &Error{Op: "readdir", Inode: inodeNumber, Path: imagePath(name), Err: ErrNotDir}
+		}
+		entries, err = f.readDir(inodeNumber, name)
+		return err
+	})
+	return
+}
+
+func (f *FS) ReadFile(name string) (data []byte, err error) {
+	err = f.run("read", name, func() error {
+		inodeNumber, err := f.e.walkPath(name, true, true)
+		if err != nil {
+			return err
+		}
+		data, err = f.e.readFile(inodeNumber, imagePath(name))
+		return err
+	})
+	return
+}
+
+// imagePath converts the io/fs name to the image path of the errors.
+func imagePath(name string) string {
+	if name == "." {
+		return "/"
+	}
+	return "/" + name
+}
+
+func (f *FS) stat(inodeNumber uint32, name string) (info *fileInfo, err error) {
+	defer inodeContext(&err, inodeNumber, imagePath(name))
+	inode, err := f.e.getInode(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	details, err := f.e.newInode(inodeNumber, inode)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), inode: details}, nil
+}
+
+func (f *FS) readDir(inodeNumber uint32, name string) (entries []fs.DirEntry, err error) {
+	var found []DirectoryEntry
+	err = func() (err error) {
+		defer inodeContext(&err, inodeNumber, imagePath(name))
+		inode, err := f.e.getInode(inodeNumber)
+		if err != nil {
+			return err
+		}
+		return inode.enumBlocks(f.e.super, func(reader *MmapCustomReader) error {
+			return f.e.enumDirectoryBlock(reader, func(entry DirectoryEntry) error {
+				if entry.inode != 0 && entry.name != "." && entry.name != ".." {
+					found = append(found, entry)
+				}
+				return nil
+			})
+		})
+	}()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(a, b int) bool { return found[a].name < found[b].name })
+	for _, entry := range found {
+		entries = append(entries, &dirEntry{fs: f, name: path.Join(name, entry.name), inode: entry.inode, filetype: entry.filetype})
+	}
+	return entries, nil
+}
+
+// filetypeModes converts the file types of the directory entries to fs.FileMode types.
+var filetypeModes = map[uint8]fs.FileMode{
+	EXT4_FT_REG_FILE: 0,
+	EXT4_FT_DIR:      fs.ModeDir,
+	EXT4_FT_CHRDEV:   fs.ModeDevice | fs.ModeCharDevice,
+	EXT4_FT_BLKDEV:   fs.ModeDevice,
+	EXT4_FT_FIFO:     fs.ModeNamedPipe,
+	EXT4_FT_SOCK:     fs.ModeSocket,
+	EXT4_FT_SYMLINK:  fs.ModeSymlink,
+}
+
+// dirEntry is the fs.DirEntry of a directory entry. The inode is read only by Info, so a damaged child
+// doesn't fail the listing of its directory.
+type dirEntry struct {
+	fs       *FS
+	name     string // the io/fs name of the entry
+	inode    uint32
+	filetype uint8
+}
+
+func (d *dirEntry) Name() string { return path.Base(d.name) }
+func (d *dirEntry) IsDir() bool  { return d.Type().IsDir() }
+
+// Type returns the type kept in the entry. Without the filetype feature it's read from the inode,
+// fs.ModeIrregular if that fails.
+func (d *dirEntry) Type() fs.FileMode {
+	if mode, ok := filetypeModes[d.filetype]; ok {
+		return mode
+	}
+	info, err := d.Info()
+	if err != nil {
+		return fs.ModeIrregular
+	}
+	return info.Mode().Type()
+}
+
+func (d *dirEntry) Info() (info fs.FileInfo, err error) {
+	err = d.fs.run("stat", d.name, func() error {
+		info, err = d.fs.stat(d.inode, d.name)
+		return err
+	})
+	return
+}
+
+func (d *dirEntry) String() string {
+	return fs.FormatDirEntry(d)
+}
+
+// fileInfo is the fs.FileInfo of an inode.
+type fileInfo struct {
+	name  string
+	inode *Inode
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return int64(i.inode.Size) }
+func (i *fileInfo) Mode() fs.FileMode  { return i.inode.FileMode() }
+func (i *fileInfo) ModTime() time.Time { return i.inode.Mtime }
+func (i *fileInfo) IsDir() bool        { return i.inode.Mode&0xf000 == EXT4SIFDIR }
+func (i *fileInfo) Sys() any           { return i.inode }
+
+// file is an open inode other than a directory. Devices, pipes and sockets read as empty.
+type file struct {
+	name   string
+	info   *fileInfo
+	reader *FileReader
+	closed bool
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// pathError converts the error of the reader, io.EOF is kept as is.
+func (f *file) pathError(op string, err error) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if _, ok := err.(*Error); ok {
+		return &fs.PathError{Op: op, Path: f.name, Err: err}
+	}
+	return err
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.pathError("read", nil)
+	}
+	n, err := f.reader.Read(p)
+	return n, f.pathError("read", err)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.pathError("read", nil)
+	}
+	n, err := f.reader.ReadAt(p, off)
+	return n, f.pathError("read", err)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.pathError("seek", nil)
+	}
+	position, err := f.reader.Seek(offset, whence)
+	return position, f.pathError("seek", err)
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return f.pathError("close", nil)
+	}
+	f.closed = true
+	return nil
+}
+
+// dir is an open directory, its entries are read by Open.
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: ErrNotRegular}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(n, len(rest))]
+	}
+	d.offset += len(rest)
+	return rest, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,682 @@
+package extfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/ImSingee/mmap"
+	"io"
+	"sort"
+	"time"
+)
+
+const JBD2_MAGIC_NUMBER = 0xc03b3998
+
+const (
+	JBD2_DESCRIPTOR_BLOCK = 1
+	JBD2_COMMIT_BLOCK     = 2
+	JBD2_SUPERBLOCK_V1    = 3
+	JBD2_SUPERBLOCK_V2    = 4
+	JBD2_REVOKE_BLOCK     = 5
+)
+
+const (
+	JBD2_FEATURE_COMPAT_CHECKSUM         = 0x1
+	JBD2_FEATURE_INCOMPAT_REVOKE         = 0x1
+	JBD2_FEATURE_INCOMPAT_64BIT          = 0x2
+	JBD2_FEATURE_INCOMPAT_ASYNC_COMMIT   = 0x4
+	JBD2_FEATURE_INCOMPAT_CSUM_V2        = 0x8
+	JBD2_FEATURE_INCOMPAT_CSUM_V3        = 0x10
+	JBD2_FEATURE_INCOMPAT_FAST_COMMIT    = 0x20
+	JBD2_FLAG_ESCAPE                     = 0x1
+	JBD2_FLAG_SAME_UUID                  = 0x2
+	JBD2_FLAG_DELETED                    = 0x4
+	JBD2_FLAG_LAST_TAG                   = 0x8
+	JOURNAL_HEADER_SIZE                  = 12
+	JOURNAL_BLOCK_TAIL_SIZE              = 4 // the checksum at the end of descriptor and revoke blocks with csum v2/v3
+	JOURNAL_DEFAULT_FAST_COMMIT_BLOCKS   = 256
+	JOURNAL_COMMIT_BLOCK_CHECKSUM_OFFSET = 0x10
+	JOURNAL_COMMIT_BLOCK_TIME_OFFSET     = 0x30
+	JOURNAL_SUPERBLOCK_USERS_OFFSET      = 0x100
+	JOURNAL_SUPERBLOCK_MAX_USERS         = 48
+	JOURNAL_SUPERBLOCK_USER_UUID_LENGTH  = 16
+)
+
+type JournalHeader struct {
+	h_magic     uint32
+	h_blocktype uint32
+	h_sequence  uint32
+}
+
+func (h *JournalHeader) parse(reader *MmapCustomReader) {
+	h.h_magic = reader.Read32be(4)
+	h.h_blocktype = reader.Read32be(4)
+	h.h_sequence = reader.Read32be(4)
+}
+
+type JournalSuperBlock struct {
+	s_header            JournalHeader
+	s_blocksize         uint32
+	s_maxlen            uint32
+	s_first             uint32
+	s_sequence          uint32
+	s_start             uint32
+	s_errno             int32
+	s_feature_compat    uint32
+	s_feature_incompat  uint32
+	s_feature_ro_compat uint32
+	s_uuid              []uint8
+	s_nr_users          uint32
+	s_dynsuper          uint32
+	s_max_transaction   uint32
+	s_max_trans_data    uint32
+	s_checksum_type     uint8
+	s_num_fc_blks       uint32
+	s_head              uint32
+	s_checksum          uint32
+	s_users             [][]uint8
+}
+
+func (j *JournalSuperBlock) parse(reader *MmapCustomReader) {
+	superBlockPosition := reader.cursorPosition
+	j.s_header.parse(reader)
+	j.s_blocksize = reader.Read32be(4)
+	j.s_maxlen = reader.Read32be(4)
+	j.s_first = reader.Read32be(4)
+	j.s_sequence = reader.Read32be(4)
+	j.s_start = reader.Read32be(4)
+	j.s_errno = int32(reader.Read32be(4))
+	if j.s_header.h_blocktype != JBD2_SUPERBLOCK_V2 { // v1 has no more fields
+		return
+	}
+	j.s_feature_compat = reader.Read32be(4)
+	j.s_feature_incompat = reader.Read32be(4)
+	j.s_feature_ro_compat = reader.Read32be(4)
+	j.s_uuid = reader.ReadN(16)
+	j.s_nr_users = reader.Read32be(4)
+	j.s_dynsuper = reader.Read32be(4)
+	j.s_max_transaction = reader.Read32be(4)
+	j.s_max_trans_data = reader.Read32be(4)
+	j.s_checksum_type = reader.Read8(4) // with s_padding2
+	j.s_num_fc_blks = reader.Read32be(4)
+	j.s_head = reader.Read32be(4)
+	reader.SetCursorValue(superBlockPosition + 0xfc)
+	j.s_checksum = reader.Read32be(4)
+	reader.SetCursorValue(superBlockPosition + JOURNAL_SUPERBLOCK_USERS_OFFSET)
+	for i := uint32(0); i < j.s_nr_users && i < JOURNAL_SUPERBLOCK_MAX_USERS; i++ {
+		j.s_users = append(j.s_users, reader.ReadN(JOURNAL_SUPERBLOCK_USER_UUID_LENGTH))
+	}
+}
+
+// JournalBlockTag is an entry of a descriptor block: the filesystem block whose copy follows the descriptor.
+type JournalBlockTag struct {
+	t_blocknr      uint32
+	t_blocknr_high uint32
+	t_flags        uint32
+	t_checksum     uint32
+}
+
+// parse decodes the tag and moves the reader past it. With csum v3 the tag is journal_block_tag3_t,
+// otherwise journal_block_tag_t: t_blocknr_high is there only with 64bit and csum v2 adds 2 bytes to the end.
+func (t *JournalBlockTag) parse(reader *MmapCustomReader, super JournalSuperBlock) {
+	tagPosition := reader.cursorPosition
+	t.t_blocknr = reader.Read32be(4)
+	if super.s_feature_incompat&JBD2_FEATURE_INCOMPAT_CSUM_V3 != 0 {
+		t.t_flags = reader.Read32be(4)
+		t.t_blocknr_high = reader.Read32be(4)
+		t.t_checksum = reader.Read32be(4)
+	} else {
+		t.t_checksum = uint32(reader.Read16be(2))
+		t.t_flags = uint32(reader.Read16be(2))
+		t.t_blocknr_high = reader.Read32be(4)
+	}
+	if super.s_feature_incompat&JBD2_FEATURE_INCOMPAT_64BIT == 0 {
+		t.t_blocknr_high = 0
+	}
+	reader.SetCursorValue(tagPosition + super.tagBytes())
+}
+
+func (t *JournalBlockTag) blocknr() uint64 {
+	return uint64(t.t_blocknr_high)<<32 | uint64(t.t_blocknr)
+}
+
+// JournalBlock is a filesystem block logged by a transaction.
+type JournalBlock struct {
+	FsBlock      uint64 // the filesystem block the copy belongs to
+	JournalBlock uint32 // where the copy is kept in the journal
+	Escaped      bool   // the copy starts with the jbd2 magic, which has been zeroed in the journal
+	BadChecksum  bool   // with csum v2/v3: the copy doesn't match the tag checksum
+}
+
+// JournalTransaction is a transaction found in the journal.
+type JournalTransaction struct {
+	Sequence   uint32
+	StartBlock uint32 // the journal block of the first descriptor or revoke block
+	Committed  bool   // the commit block was found
+	// BadChecksum is set with csum v2/v3 when a descriptor, revoke or commit block or a logged copy fails its
+	// checksum. Such a transaction is never replayed, the recovery stops before it.
+	BadChecksum bool
+	CommitTime  time.Time
+	Blocks      []JournalBlock
+	Revoked     []uint64 // filesystem blocks whose older journal copies must not be replayed
+}
+
+// Journal is the jbd2 journal of a filesystem.
+type Journal struct {
+	super            JournalSuperBlock
+	superBlockNumber uint32
+	reader           MmapCustomReader
+	blocks           []uint64 // journal block -> filesystem block, nil for external journals
+	fsBlocksize      uint64
+	transactions     []JournalTransaction
+	fastCommits      []FastCommitTag
+	csumSeed         uint32         // crc32c of the journal UUID, the seed of the csum v2/v3 checksums
+	owner            *ExtFileSystem // the filesystem ReadJournal opened, closed by Close
+}
+
+// Journal parses the journal inode or the external journal device (see Options.ExternalJournal).
+// It returns nil if the filesystem has no journal.
+func (e *ExtFileSystem) Journal() (journal *Journal, err error) {
+	return e.journal()
+}
+
+func (e *ExtFileSystem) journal() (journal *Journal, err error) {
+	if e.super.s_feature_compat&EXT4_FEATURE_COMPAT_HAS_JOURNAL == 0 {
+		return nil, nil
+	}
+	if e.super.s_journal_inum == 0 {
+		return e.externalJournal()
+	}
+	if e.options.ExternalJournal != "" {
+		return nil, newError("journal open", ErrInvalidOptions, "ExternalJournal is set, but the filesystem has an internal journal")
+	}
+	defer inodeContext(&err, e.super.s_journal_inum, "")
+	inode, err := e.getInode(e.super.s_journal_inum)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{reader: e.super.reader, fsBlocksize: e.super.Blocksize()}
+	err = inode.enumRuns(e.super, func(run blockRun) error {
+		for n := uint64(0); n < run.length; n++ {
+			for uint64(len(j.blocks)) < run.logical+n {
+				j.blocks = append(j.blocks, 0) // a hole, a valid journal has none
+			}
+			j.blocks = append(j.blocks, run.physical+n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := j.parse(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// externalJournal opens the journal device. Its ext superblock must have the journal_dev feature and the UUID
+// the filesystem refers to. Journal blocks are the device blocks, the journal superblock follows the ext one.
+func (e *ExtFileSystem) externalJournal() (*Journal, error) {
+	if e.options.ExternalJournal == "" {
+		return nil, newError("journal open", ErrInvalidOptions, "the journal is on an external device, set ExternalJournal")
+	}
+	if e.journalDevice == nil {
+		file, err := mmap.New(mmap.NewReadOnly(e.options.ExternalJournal))
+		if err != nil {
+			return nil, ioError("journal open", err)
+		}
+		e.journalDevice = file
+	}
+	reader := MmapCustomReader{mmapInstance: e.journalDevice}
+	reader.SetCursorValue(0x400)
+	var deviceSuper SuperBlock
+	if err := deviceSuper.Parse(reader); err != nil {
+		return nil, err
+	}
+	if deviceSuper.s_magic != 0xef53 || deviceSuper.s_feature_incompat&EXT4_FEATURE_INCOMPAT_JOURNAL_DEV == 0 {
+		return nil, newError("journal open", ErrBadMagic, "%s is not an external journal device", e.options.ExternalJournal)
+	}
+	if !bytes.Equal(deviceSuper.s_uuid, e.super.s_journal_uuid) {
+		return nil, newError("journal open", ErrInvalidOptions, "journal device UUID %x doesn't match s_journal_uuid %x",
+			deviceSuper.s_uuid, e.super.s_journal_uuid)
+	}
+	j := &Journal{reader: reader, fsBlocksize: deviceSuper.Blocksize(), superBlockNumber: deviceSuper.s_first_data_block + 1}
+	if j.fsBlocksize != e.super.Blocksize() {
+		return nil, newError("journal open", ErrCorrupt, "journal device blocksize %d differs from filesystem blocksize %d",
+			j.fsBlocksize, e.super.Blocksize())
+	}
+	if err := j.parse(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// ReadJournal parses the journal of the image at targetPath. It returns nil if the filesystem has no journal.
+// The image stays mapped, as the journal reads the logged blocks from it, until the journal is closed.
+func ReadJournal(targetPath string, options Options) (*Journal, error) {
+	fs, err := Open(targetPath, options)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := fs.Journal()
+	if journal == nil {
+		fs.Close()
+		return nil, err
+	}
+	journal.owner = fs
+	return journal, nil
+}
+
+// Close unmaps the image and the journal device of a journal returned by ReadJournal. It does nothing for
+// the journals of ExtFileSystem.Journal, they are released by ExtFileSystem.Close.
+func (j *Journal) Close() error {
+	if j.owner == nil {
+		return nil
+	}
+	owner := j.owner
+	j.owner = nil
+	return owner.Close()
+}
+
+func (j *Journal) parse() error {
+	if j.blocks != nil && len(j.blocks) == 0 {
+		return newError("journal parse", ErrCorrupt, "the journal is empty")
+	}
+	reader, err := j.block(j.superBlockNumber)
+	if err != nil {
+		return err
+	}
+	j.super.parse(reader)
+	if err := reader.Err(); err != nil {
+		return err
+	}
+	if j.super.s_header.h_magic != JBD2_MAGIC_NUMBER {
+		return newError("journal parse", ErrBadMagic, "journal superblock: %#x", j.super.s_header.h_magic)
+	}
+	if j.super.s_header.h_blocktype != JBD2_SUPERBLOCK_V1 && j.super.s_header.h_blocktype != JBD2_SUPERBLOCK_V2 {
+		return newError("journal parse", ErrCorrupt, "unknown journal superblock type %d", j.super.s_header.h_blocktype)
+	}
+	if uint64(j.super.s_blocksize) != j.fsBlocksize {
+		return newError("journal parse", ErrCorrupt, "journal blocksize %d differs from filesystem blocksize %d",
+			j.super.s_blocksize, j.fsBlocksize)
+	}
+	if j.hasBlockTail() {
+		j.csumSeed = crc32c(^uint32(0), j.super.s_uuid)
+	}
+	if err := j.scan(); err != nil {
+		return err
+	}
+	return j.scanFastCommits()
+}
+
+// block returns a reader at the beginning of the journal block.
+func (j *Journal) block(n uint32) (*MmapCustomReader, error) {
+	physical := uint64(n)
+	if j.blocks != nil {
+		if uint64(n) >= uint64(len(j.blocks)) || j.blocks[n] == 0 {
+			return nil, newError("journal block", ErrBlockOutOfRange, "block %d is out of the journal", n)
+		}
+		physical = j.blocks[n]
+	}
+	reader := j.reader
+	reader.SetCursorValue(int64(physical * j.fsBlocksize))
+	return &reader, nil
+}
+
+// readBlock returns the content of the journal block.
+func (j *Journal) readBlock(n uint32) ([]byte, error) {
+	reader, err := j.block(n)
+	if err != nil {
+		return nil, err
+	}
+	data := reader.ReadN(int64(j.fsBlocksize))
+	return data, reader.Err()
+}
+
+// last returns the number of the block after the log area, the fast commit area follows it.
+func (j *Journal) last() uint32 {
+	last := j.super.s_maxlen
+	if j.blocks != nil && uint64(last) > uint64(len(j.blocks)) {
+		last = uint32(len(j.blocks))
+	}
+	return last - j.fastCommitBlocks()
+}
+
+// next returns the log block after n, the log is circular.
+func (j *Journal) next(n uint32) uint32 {
+	n++
+	if n >= j.last() {
+		n = j.super.s_first
+	}
+	return n
+}
+
+// tagBytes is jbd2_journal_tag_bytes: the size of a descriptor block tag without the UUID.
+func (j *JournalSuperBlock) tagBytes() int64 {
+	if j.s_feature_incompat&JBD2_FEATURE_INCOMPAT_CSUM_V3 != 0 {
+		return 16
+	}
+	size := int64(12)
+	if j.s_feature_incompat&JBD2_FEATURE_INCOMPAT_CSUM_V2 != 0 {
+		size += 2
+	}
+	if j.s_feature_incompat&JBD2_FEATURE_INCOMPAT_64BIT == 0 {
+		size -= 4
+	}
+	return size
+}
+
+func (j *Journal) hasBlockTail() bool {
+	return j.super.s_feature_incompat&(JBD2_FEATURE_INCOMPAT_CSUM_V2|JBD2_FEATURE_INCOMPAT_CSUM_V3) != 0
+}
+
+// checksumValid verifies the csum v2/v3 checksum of the block n kept at the given offset: the crc32c of the block
+// with the checksum field zeroed. Descriptor and revoke blocks keep it in the tail, commit blocks in h_chksum[0].
+func (j *Journal) checksumValid(n uint32, offset int) (bool, error) {
+	if !j.hasBlockTail() {
+		return true, nil
+	}
+	data, err := j.readBlock(n)
+	if err != nil {
+		return false, err
+	}
+	stored := binary.BigEndian.Uint32(data[offset:])
+	binary.BigEndian.PutUint32(data[offset:], 0)
+	return crc32c(j.csumSeed, data) == stored, nil
+}
+
+// tagChecksumValid is jbd2_block_tag_csum_verify: the crc32c of the sequence number and the copy as it's kept
+// in the journal. csum v2 tags keep its low 16 bits.
+func (j *Journal) tagChecksumValid(tag JournalBlockTag, sequence uint32, n uint32) (bool, error) {
+	if !j.hasBlockTail() {
+		return true, nil
+	}
+	data, err := j.readBlock(n)
+	if err != nil {
+		return false, err
+	}
+	csum := crc32c(j.csumSeed, binary.BigEndian.AppendUint32(nil, sequence))
+	csum = crc32c(csum, data)
+	if j.super.s_feature_incompat&JBD2_FEATURE_INCOMPAT_CSUM_V3 != 0 {
+		return csum == tag.t_checksum, nil
+	}
+	return uint16(csum) == uint16(tag.t_checksum), nil
+}
+
+// scan looks through every block of the log area, so it finds the transactions that are already checkpointed
+// as long as they haven't been overwritten. Data blocks never start with the magic (they are escaped),
+// so every block with it is a descriptor, commit or revoke block. With csum v2/v3 the checksums are verified,
+// see JournalTransaction.BadChecksum.
+func (j *Journal) scan() error {
+	transactions := make(map[uint32]*JournalTransaction)
+	getTransaction := func(header JournalHeader, n uint32) *JournalTransaction {
+		transaction, ok := transactions[header.h_sequence]
+		if !ok {
+			transaction = &JournalTransaction{Sequence: header.h_sequence, StartBlock: n}
+			transactions[header.h_sequence] = transaction
+		}
+		return transaction
+	}
+	for n := j.super.s_first; n < j.last(); n++ {
+		reader, err := j.block(n)
+		if err != nil {
+			return err
+		}
+		var header JournalHeader
+		header.parse(reader)
+		if header.h_magic != JBD2_MAGIC_NUMBER {
+			if err := reader.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		switch header.h_blocktype {
+		case JBD2_DESCRIPTOR_BLOCK:
+			transaction := getTransaction(header, n)
+			valid, err := j.checksumValid(n, int(j.fsBlocksize)-JOURNAL_BLOCK_TAIL_SIZE)
+			if err != nil {
+				return err
+			}
+			transaction.BadChecksum = transaction.BadChecksum || !valid
+			blocks, err := j.parseDescriptorBlock(reader, header.h_sequence, n)
+			if err != nil {
+				return err
+			}
+			for _, block := range blocks {
+				transaction.BadChecksum = transaction.BadChecksum || block.BadChecksum
+				transaction.Blocks = append(transaction.Blocks, block)
+			}
+		case JBD2_COMMIT_BLOCK:
+			transaction := getTransaction(header, n)
+			transaction.Committed = true
+			valid, err := j.checksumValid(n, JOURNAL_COMMIT_BLOCK_CHECKSUM_OFFSET)
+			if err != nil {
+				return err
+			}
+			transaction.BadChecksum = transaction.BadChecksum || !valid
+			reader.SetCursorValue(reader.cursorPosition - JOURNAL_HEADER_SIZE + JOURNAL_COMMIT_BLOCK_TIME_OFFSET)
+			seconds := reader.Read64be(8)     // h_commit_sec
+			nanoseconds := reader.Read32be(4) // h_commit_nsec
+			transaction.CommitTime = time.Unix(int64(seconds), int64(nanoseconds))
+		case JBD2_REVOKE_BLOCK:
+			transaction := getTransaction(header, n)
+			valid, err := j.checksumValid(n, int(j.fsBlocksize)-JOURNAL_BLOCK_TAIL_SIZE)
+			if err != nil {
+				return err
+			}
+			transaction.BadChecksum = transaction.BadChecksum || !valid
+			transaction.Revoked = append(transaction.Revoked, j.parseRevokeBlock(reader)...)
+		}
+		if err := reader.Err(); err != nil {
+			return err
+		}
+	}
+	j.transactions = nil
+	for _, transaction := range transactions {
+		j.transactions = append(j.transactions, *transaction)
+	}
+	sort.Slice(j.transactions, func(a, b int) bool {
+		// sequence numbers wrap around, so they are compared relatively to the journal one
+		return int32(j.transactions[a].Sequence-j.super.s_sequence) < int32(j.transactions[b].Sequence-j.super.s_sequence)
+	})
+	return nil
+}
+
+// parseDescriptorBlock decodes the tags, the reader is right after the header. n is the descriptor position.
+func (j *Journal) parseDescriptorBlock(reader *MmapCustomReader, sequence uint32, n uint32) (blocks []JournalBlock, err error) {
+	end := reader.cursorPosition - JOURNAL_HEADER_SIZE + int64(j.fsBlocksize)
+	if j.hasBlockTail() {
+		end -= JOURNAL_BLOCK_TAIL_SIZE
+	}
+	dataBlock := n
+	for reader.cursorPosition+j.super.tagBytes() <= end {
+		var tag JournalBlockTag
+		tag.parse(reader, j.super)
+		if tag.t_flags&JBD2_FLAG_SAME_UUID == 0 {
+			reader.cursorPosition += 16
+		}
+		dataBlock = j.next(dataBlock)
+		valid, err := j.tagChecksumValid(tag, sequence, dataBlock)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, JournalBlock{
+			FsBlock:      tag.blocknr(),
+			JournalBlock: dataBlock,
+			Escaped:      tag.t_flags&JBD2_FLAG_ESCAPE != 0,
+			BadChecksum:  !valid,
+		})
+		if tag.t_flags&JBD2_FLAG_LAST_TAG != 0 {
+			break
+		}
+	}
+	return blocks, nil
+}
+
+// parseRevokeBlock decodes the revoked block numbers, the reader is right after the header.
+func (j *Journal) parseRevokeBlock(reader *MmapCustomReader) (revoked []uint64) {
+	start := reader.cursorPosition - JOURNAL_HEADER_SIZE
+	count := int64(reader.Read32be(4)) // r_count is the number of used bytes including the header
+	limit := int64(j.fsBlocksize)
+	if j.hasBlockTail() {
+		limit -= JOURNAL_BLOCK_TAIL_SIZE
+	}
+	count = min(count, limit)
+	for reader.cursorPosition < start+count {
+		if j.super.s_feature_incompat&JBD2_FEATURE_INCOMPAT_64BIT != 0 {
+			revoked = append(revoked, reader.Read64be(8))
+		} else {
+			revoked = append(revoked, uint64(reader.Read32be(4)))
+		}
+	}
+	return
+}
+
+func (j *Journal) transaction(sequence uint32) *JournalTransaction {
+	for ind := range j.transactions {
+		if j.transactions[ind].Sequence == sequence {
+			return &j.transactions[ind]
+		}
+	}
+	return nil
+}
+
+// recoveryTransactions returns the transactions the kernel would replay on mount: the committed ones
+// going one by one from the log start.
+func (j *Journal) recoveryTransactions() (transactions []JournalTransaction) {
+	if j.super.s_start == 0 {
+		return nil
+	}
+	for sequence := j.super.s_sequence; ; sequence++ {
+		transaction := j.transaction(sequence)
+		if transaction == nil || !transaction.Committed || transaction.BadChecksum {
+			return
+		}
+		transactions = append(transactions, *transaction)
+	}
+}
+
+// transactionsUpTo returns the committed transactions with sequence numbers up to the given one. Transactions
+// that fail their checksums are left out. The already checkpointed ones, before s_sequence, are included
+// only with csum v2/v3: their log blocks may have been reused since, and only the checksums tell it.
+func (j *Journal) transactionsUpTo(sequence uint32) (transactions []JournalTransaction, err error) {
+	last := j.transaction(sequence)
+	if last == nil || !last.Committed {
+		return nil, newError("journal replay", ErrInvalidOptions, "there is no committed transaction %d in the journal", sequence)
+	}
+	if last.BadChecksum {
+		return nil, newError("journal replay", ErrCorrupt, "transaction %d fails its checksums", sequence)
+	}
+	checkpointed := func(transaction JournalTransaction) bool {
+		return int32(transaction.Sequence-j.super.s_sequence) < 0
+	}
+	if checkpointed(*last) && !j.hasBlockTail() {
+		return nil, newError("journal replay", ErrInvalidOptions,
+			"transaction %d is checkpointed and the journal has no checksums to verify its blocks", sequence)
+	}
+	for _, transaction := range j.transactions {
+		if checkpointed(transaction) && !j.hasBlockTail() {
+			continue
+		}
+		if transaction.Committed && !transaction.BadChecksum && int32(transaction.Sequence-sequence) <= 0 {
+			transactions = append(transactions, transaction)
+		}
+	}
+	return transactions, nil
+}
+
+// replay returns the latest logged version of every block written by the transactions. A block isn't replayed
+// from a transaction if it's revoked by the same or a later one.
+func (j *Journal) replay(transactions []JournalTransaction) (map[uint64][]byte, error) {
+	revoked := make(map[uint64]uint32)
+	for _, transaction := range transactions {
+		for _, block := range transaction.Revoked {
+			if sequence, ok := revoked[block]; !ok || int32(transaction.Sequence-sequence) > 0 {
+				revoked[block] = transaction.Sequence
+			}
+		}
+	}
+	blocks := make(map[uint64][]byte)
+	for _, transaction := range transactions {
+		for _, block := range transaction.Blocks {
+			if sequence, ok := revoked[block.FsBlock]; ok && int32(transaction.Sequence-sequence) <= 0 {
+				continue
+			}
+			data, err := j.blockData(block)
+			if err != nil {
+				return nil, err
+			}
+			blocks[block.FsBlock] = data
+		}
+	}
+	return blocks, nil
+}
+
+// Transactions returns the transactions found in the journal ordered by their sequence numbers.
+// It includes already checkpointed transactions that are still in the journal.
+func (j *Journal) Transactions() []JournalTransaction {
+	return j.transactions
+}
+
+// Sequence returns the sequence number of the first transaction expected in the log.
+func (j *Journal) Sequence() uint32 {
+	return j.super.s_sequence
+}
+
+// Start returns the journal block where the log begins. Zero means the journal is empty (clean).
+func (j *Journal) Start() uint32 {
+	return j.super.s_start
+}
+
+// BlockData returns the content of the logged copy with the escaped magic restored.
+func (j *Journal) BlockData(block JournalBlock) (data []byte, err error) {
+	return j.blockData(block)
+}
+
+func (j *Journal) blockData(block JournalBlock) ([]byte, error) {
+	data, err := j.readBlock(block.JournalBlock)
+	if err != nil {
+		return nil, err
+	}
+	if block.Escaped {
+		data[0], data[1], data[2], data[3] = 0xc0, 0x3b, 0x39, 0x98
+	}
+	return data, nil
+}
+
+// Dump writes a logdump-like listing of the journal.
+func (j *Journal) Dump(w io.Writer) {
+	fmt.Fprintf(w, "Journal starts at block %d, transaction %d\n", j.super.s_start, j.super.s_sequence)
+	for _, transaction := range j.transactions {
+		state := "uncommitted"
+		if transaction.Committed {
+			state = "committed " + transaction.CommitTime.UTC().Format(time.RFC3339Nano)
+		}
+		if transaction.BadChecksum {
+			state += ", bad checksum"
+		}
+		fmt.Fprintf(w, "Transaction %d at block %d (%s)\n", transaction.Sequence, transaction.StartBlock, state)
+		for _, block := range transaction.Blocks {
+			fmt.Fprintf(w, "  FS block %d logged at journal block %d", block.FsBlock, block.JournalBlock)
+			if block.BadChecksum {
+				fmt.Fprint(w, " (bad checksum)")
+			}
+			fmt.Fprintln(w)
+		}
+		for _, block := range transaction.Revoked {
+			fmt.Fprintf(w, "  Revoke FS block %d\n", block)
+		}
+	}
+	for _, tag := range j.fastCommits {
+		fmt.Fprintf(w, "Fast commit tag %d of transaction %d: inode %d", tag.Tag, tag.Tid, tag.Inode)
+		switch tag.Tag {
+		case EXT4_FC_TAG_ADD_RANGE:
+			fmt.Fprintf(w, ", blocks %d-%d at FS block %d", tag.Logical, tag.Logical+tag.Length-1, tag.Physical)
+		case EXT4_FC_TAG_DEL_RANGE:
+			fmt.Fprintf(w, ", blocks %d-%d", tag.Logical, tag.Logical+tag.Length-1)
+		case EXT4_FC_TAG_CREAT, EXT4_FC_TAG_LINK, EXT4_FC_TAG_UNLINK:
+			fmt.Fprintf(w, ", entry %q in directory %d", tag.Name, tag.Parent)
+		}
+		fmt.Fprintln(w)
+	}
+}
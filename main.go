@@ -6,10 +6,13 @@
 package extfs
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/ImSingee/mmap"
-	"log"
+	"io/fs"
 	"os"
-	"time"
+	"path/filepath"
 )
 
 const (
@@ -24,44 +27,165 @@ const (
 )
 
 const ROOTDIRINODE = 2
+const EXT4SIFIFO = 0x1000
+const EXT4SIFCHR = 0x2000
 const EXT4SIFDIR = 0x4000
+const EXT4SIFBLK = 0x6000
+const EXT4SIFREG = 0x8000
 const EXT4SIFLNK = 0xa000
+const EXT4SIFSOCK = 0xc000
 const EXT4EXTENTSFL = 0x00080000 /* Inode using extents */
-const EXT4_FEATURE_INCOMPAT_EXTENTS = 0x40
-const EXT4_FEATURE_INCOMPAT_64BIT = 0x80
+const EXT4_BG_INODE_UNINIT = 0x1
+const EXT4_BG_BLOCK_UNINIT = 0x2
+const EXT4_BG_INODE_ZEROED = 0x4
+
+// Options controls how an image is parsed. The zero value is the default behaviour.
+type Options struct {
+	// ReplayJournal applies the committed journal transactions to an in-memory overlay when the filesystem
+	// wasn't unmounted cleanly (needs_recovery is set), as the kernel does on mount. The image is never modified.
+	ReplayJournal bool
+	// AsOfTransaction opens the filesystem as it was right after the journal transaction with this sequence number
+	// had been committed: every block logged by the committed transactions up to it is read from its latest journal
+	// copy. Blocks that aren't logged by them keep their current on-disk content. Transactions failing their
+	// checksums are left out, see JournalTransaction.BadChecksum. Without csum v2/v3 the journal can't tell
+	// reused log blocks, so the checkpointed transactions (before Journal.Sequence) aren't used and can't be
+	// asked for. Zero disables it.
+	AsOfTransaction uint32
+	// ExternalJournal is the image of the journal device for filesystems that keep the journal outside
+	// (s_journal_uuid/s_journal_dev). It's used for journal parsing and replay like an internal journal.
+	ExternalJournal string
+	// ReplayFastCommit also applies the fast commits that follow the replayed transactions (the fast_commit
+	// feature), when ReplayJournal is set. The inodes, block ranges and directory entries they log are replayed;
+	// inodes whose ranges would need extent tree blocks are skipped, see ExtFileSystem.SkippedFastCommits.
+	ReplayFastCommit bool
+	// SuperBlockGroup reads the filesystem with the backup superblock and group descriptors of the group instead
+	// of the primary ones. When it's zero, backups are used only if the primary copy is damaged,
+	// see ExtFileSystem.SuperBlockCopy.
+	SuperBlockGroup uint32
+	// PermissiveFeatures makes parsing go on when the filesystem has incompat features that aren't implemented
+	// instead of refusing it. ExtFileSystem.Features().Unsupported() lists them, as the filesystem may be misread.
+	PermissiveFeatures bool
+	// BlocksPerGroup helps to find the backups when the primary superblock is unreadable and the filesystem wasn't
+	// made with the default 8 * blocksize blocks per group.
+	BlocksPerGroup uint32
+	// ImageOffset is the byte offset of the filesystem inside the image, e.g. the start of a partition
+	// of a disk image. Every read of the filesystem is shifted by it.
+	ImageOffset int64
+	// MaxSymlinks is the number of symlinks a path lookup follows before it fails with ErrSymlinkLoop (ELOOP),
+	// 40 like in Linux when it's zero.
+	MaxSymlinks int
+}
 
 type ExtFileSystem struct {
-	super            SuperBlock
-	bgdescs          []BlockGroupDescriptor
-	bgroups          []BlockGroup
-	superBlockOffset int64
+	super              SuperBlock
+	bgdescs            []BlockGroupDescriptor
+	bgroups            []BlockGroup
+	superBlockOffset   int64
+	options            Options
+	image              *mmap.Mmap
+	journalDevice      *mmap.Mmap
+	superBlockCopy     SuperBlockCopy
+	skippedFastCommits []Damage
+}
+
+func (e *ExtFileSystem) parse(reader MmapCustomReader) error {
+	if reader.overlay == nil {
+		reader.overlay = &blockOverlay{}
+	}
+	if err := e.selectSuperBlock(reader); err != nil {
+		return err
+	}
+	if err := e.parseMetadata(reader); err != nil {
+		return err
+	}
+	if err := e.checkFeatures(); err != nil {
+		return err
+	}
+	if e.options.AsOfTransaction != 0 {
+		journal, err := e.journal()
+		if err != nil {
+			return err
+		}
+		if journal == nil {
+			return newError("parse", ErrInvalidOptions, "AsOfTransaction is set, but the filesystem has no journal")
+		}
+		transactions, err := journal.transactionsUpTo(e.options.AsOfTransaction)
+		if err != nil {
+			return err
+		}
+		return e.applyOverlay(reader, journal, transactions)
+	} else if e.options.ReplayJournal && e.super.s_feature_incompat&EXT4_FEATURE_INCOMPAT_RECOVER != 0 {
+		journal, err := e.journal()
+		if err != nil || journal == nil {
+			return err
+		}
+		transactions := journal.recoveryTransactions()
+		if err := e.applyOverlay(reader, journal, transactions); err != nil {
+			return err
+		}
+		if e.options.ReplayFastCommit {
+			if err := e.replayFastCommits(reader, journal.recoveryFastCommits(transactions)); err != nil {
+				return err
+			}
+		}
+		e.super.s_feature_incompat &^= EXT4_FEATURE_INCOMPAT_RECOVER
+	}
+	return nil
+}
+
+// applyOverlay makes the reader see the blocks the transactions logged instead of the image content and parses
+// the metadata again.
+func (e *ExtFileSystem) applyOverlay(reader MmapCustomReader, journal *Journal, transactions []JournalTransaction) error {
+	blocks, err := journal.replay(transactions)
+	if err != nil {
+		return err
+	}
+	reader.overlay.blocksize = int64(e.super.Blocksize())
+	reader.overlay.blocks = blocks
+	return e.parseMetadata(reader)
 }
 
-func (e *ExtFileSystem) parse(reader MmapCustomReader) {
+// parseMetadata parses the superblock and the group descriptors.
+func (e *ExtFileSystem) parseMetadata(reader MmapCustomReader) error {
+	e.bgdescs = nil
+	e.bgroups = nil
 	reader.SetCursorValue(e.superBlockOffset)
-	e.super.Parse(reader)
+	if err := e.super.Parse(reader); err != nil {
+		return err
+	}
 	if e.super.s_magic != 0xef53 {
-		log.Panicf("extfs parse: not an ext2 filesystem.")
+		return newError("parse", ErrBadMagic, "not an ext2 filesystem: superblock magic %#x", e.super.s_magic)
 	}
 	bgdescpos := e.getBlockGroupDescPosition()
 	reader.SetCursorValue(int64(bgdescpos))
 
-	if (e.super.s_feature_incompat&EXT4_FEATURE_INCOMPAT_EXTENTS != 0x0) &&
-		(e.super.s_feature_incompat&EXT4_FEATURE_INCOMPAT_64BIT != 0x0) {
+	if e.useExt4Descriptors() {
 		e.parseGroupDescs(&reader, Ext4BlockGroupDescriptorFabric)
 	} else {
 		e.parseGroupDescs(&reader, DefaultBlockGroupDescriptorFabric)
 	}
+	if err := reader.Err(); err != nil {
+		return err
+	}
 	e.parseBlockGroups()
+	return nil
 }
 
-func (e *ExtFileSystem) getBlockGroupDescPosition() (bgdescpos uint64) {
-	if e.super.Blocksize() == 1024 {
-		bgdescpos = 2048
-	} else {
-		bgdescpos = e.super.Blocksize()
+// descSize returns the size of a group descriptor, s_desc_size is used only with the 64bit feature.
+func (e *ExtFileSystem) descSize() int {
+	if e.super.s_feature_incompat&EXT4_FEATURE_INCOMPAT_64BIT != 0 && e.super.s_desc_size >= 64 {
+		return int(e.super.s_desc_size)
 	}
-	return
+	return 32
+}
+
+func (e *ExtFileSystem) useExt4Descriptors() bool {
+	return e.descSize() >= 64
+}
+
+// getBlockGroupDescPosition returns where the descriptor table is: the block after the superblock copy in use.
+func (e *ExtFileSystem) getBlockGroupDescPosition() (bgdescpos uint64) {
+	return (uint64(e.superBlockOffset)/e.super.Blocksize() + 1) * e.super.Blocksize()
 }
 
 func (e *ExtFileSystem) parseGroupDescs(reader *MmapCustomReader, blockGroupDescVersionFabric func() BlockGroupDescriptor) {
@@ -70,7 +194,7 @@ func (e *ExtFileSystem) parseGroupDescs(reader *MmapCustomReader, blockGroupDesc
 
 	for i := 0; i < ngroups; i++ {
 		blockGroupDescInstance := blockGroupDescVersionFabric()
-		reader.SetCursorValue(initialCursor + int64(i*blockGroupDescInstance.getSize()))
+		reader.SetCursorValue(initialCursor + int64(i*e.descSize()))
 		blockGroupDescInstance.parse(reader)
 		e.bgdescs = append(e.bgdescs, blockGroupDescInstance)
 	}
@@ -85,24 +209,148 @@ func (e *ExtFileSystem) parseBlockGroups() {
 	}
 }
 
-func (e *ExtFileSystem) getInode(inodeNumber uint32) DefaultInodeTable {
-	inodeNumber--
-	if inodeNumber >= e.super.s_inodes_count {
-		inodeNumber = 0
+func (e *ExtFileSystem) getInode(inodeNumber uint32) (DefaultInodeTable, error) {
+	if inodeNumber == 0 || inodeNumber > e.super.s_inodes_count {
+		return DefaultInodeTable{}, newError("getInode", ErrInodeOutOfRange, "inode %d, the filesystem has %d",
+			inodeNumber, e.super.s_inodes_count)
 	}
+	inodeNumber--
 	blockGroupNumber := inodeNumber / e.super.s_inodes_per_group
 	localInodeNumber := inodeNumber % e.super.s_inodes_per_group // relative to the current BlockGroup
 	return e.bgroups[blockGroupNumber].getInode(localInodeNumber)
 }
 
+// inodeAllocated checks the inode bitmap. Groups with INODE_UNINIT have no allocated inodes.
+func (e *ExtFileSystem) inodeAllocated(inodeNumber uint32) (bool, error) {
+	if inodeNumber == 0 || inodeNumber > e.super.s_inodes_count {
+		return false, nil
+	}
+	inodeNumber--
+	desc := e.bgdescs[inodeNumber/e.super.s_inodes_per_group]
+	if desc.getFlags()&EXT4_BG_INODE_UNINIT != 0 {
+		return false, nil
+	}
+	bit := inodeNumber % e.super.s_inodes_per_group
+	reader, err := e.super.GetBlock(desc.getInodeBitmapBlock())
+	if err != nil {
+		return false, err
+	}
+	reader.SetCursorValue(reader.cursorPosition + int64(bit/8))
+	allocated := reader.Read8(1)&(1<<(bit%8)) != 0
+	return allocated, reader.Err()
+}
+
+// UnpackOptions tunes how FsUnpacker writes the image content to the disk.
+// The zero value is the default behaviour.
+type UnpackOptions struct {
+	Options
+	// BreakHardLinks makes every directory entry an independent copy instead of
+	// a hard link to the first extracted entry of the same inode.
+	BreakHardLinks bool
+	// DeviceTablePath is where device nodes, FIFOs and sockets that can't be created with mknod
+	// (usually because of missing privileges) are recorded in the makedevs/genext2fs device table format.
+	// Defaults to DefaultDeviceTableName inside the extraction directory. The file is created only when needed.
+	DeviceTablePath string
+	// RestoreOwnership chowns extracted files, symlinks, nodes and directories to their image owners.
+	// It has effect only when running as root.
+	RestoreOwnership bool
+	// UIDMap and GIDMap remap image ids before chown, e.g. for user-namespace shifts.
+	// When a map is set, ids it doesn't cover are mapped to OverflowID.
+	UIDMap []IDMapping
+	GIDMap []IDMapping
+	// MetadataDBPath enables the pseudo/fakeroot-like database: a JSON line (MetadataRecord) per extracted path
+	// with the full inode metadata, including what can't be applied without root (owners, device numbers, xattrs,
+	// setuid bits).
+	MetadataDBPath string
+	// Umask is cleared from the permission bits of every restored mode.
+	Umask os.FileMode
+	// OrphanDir enables the recovery of orphan inodes (see ExtFileSystem.Orphans): the content of orphan files
+	// and symlinks is written there as #<inode number>. They have no names, as they were unlinked while open.
+	OrphanDir string
+	// Progress is called as the extraction goes on: after every extracted inode, every progressStep bytes
+	// of file data and once at the end. It's called from the extracting goroutine.
+	Progress func(Progress)
+}
+
+const DefaultDeviceTableName = ".extfs-devices"
+
+// OverflowID is the owner of files whose image ids aren't covered by UnpackOptions.UIDMap/GIDMap.
+const OverflowID = 65534
+
+// IDMapping maps Size consecutive image ids starting at ImageID onto host ids starting at HostID,
+// the same way as a line of /proc/<pid>/uid_map does.
+type IDMapping struct {
+	ImageID uint32
+	HostID  uint32
+	Size    uint32
+}
+
+func mapID(mappings []IDMapping, id uint32) uint32 {
+	if len(mappings) == 0 {
+		return id
+	}
+	for _, m := range mappings {
+		if id >= m.ImageID && id-m.ImageID < m.Size {
+			return m.HostID + (id - m.ImageID)
+		}
+	}
+	return OverflowID
+}
+
 type FsUnpacker struct {
-	fs       ExtFileSystem
-	savePath string
+	fs                *ExtFileSystem
+	savePath          string
+	options           UnpackOptions
+	exportedInodes    map[uint32]string // inode number -> path of its first extracted copy
+	deviceTable       *os.File
+	metadataDB        *metadataDB
+	directories       []exportedDirectory // in creation order, so parents always precede their children
+	walkedDirectories map[uint32]bool
+	damage            *DamageReport // collects what was skipped in salvage mode, nil otherwise
+	ctx               context.Context
+	progress          Progress
+	reportedBytes     uint64 // Progress.Bytes when Progress was called last
+}
+
+type exportedDirectory struct {
+	inode DefaultInodeTable
+	path  string
 }
 
-func (f *FsUnpacker) perform() {
+func (f *FsUnpacker) perform() (err error) {
+	f.exportedInodes = make(map[uint32]string)
+	f.walkedDirectories = make(map[uint32]bool)
+	f.startProgress()
+	defer func() {
+		if closeErr := f.closeDeviceTable(); err == nil {
+			err = closeErr
+		}
+	}()
 	inodeNumber := ROOTDIRINODE
-	f.recurseDirs(uint32(inodeNumber), "", func(entry DirectoryEntry, currentPath string) {
+	if f.options.MetadataDBPath != "" {
+		if f.metadataDB, err = createMetadataDB(f.options.MetadataDBPath); err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := f.metadataDB.close(); err == nil {
+				err = closeErr
+			}
+		}()
+		if err := f.recordMetadata(uint32(inodeNumber), "/"); err != nil {
+			return err
+		}
+	}
+	err = f.recurseDirs(uint32(inodeNumber), "", func(entry DirectoryEntry, currentPath string) (err error) {
+		imagePath := "/" + filepath.Join(currentPath, entry.name)
+		defer inodeContext(&err, entry.inode, imagePath)
+		if err := f.checkCanceled(); err != nil {
+			return err
+		}
+		if f.metadataDB != nil {
+			if err := f.salvage(entry.inode, imagePath, 0, DamageSkipped, f.recordMetadata(entry.inode, imagePath)); err != nil {
+				return err
+			}
+		}
 		var pathForMkdir string
 		if currentPath == "" {
 			pathForMkdir = f.savePath + "/" + entry.name
@@ -110,103 +358,350 @@ func (f *FsUnpacker) perform() {
 			pathForMkdir = f.savePath + "/" + currentPath + "/" + entry.name
 		}
 		if entry.filetype == EXT4_FT_DIR {
-			if err := os.Mkdir(pathForMkdir, 0777); err != nil {
-				log.Panicf("perform: mkdir wasn't completed: %v", err)
+			// the directory stays writable until its children are written, see applyDirectoriesMetadata
+			if err := os.Mkdir(pathForMkdir, 0700); err != nil {
+				return hostError("mkdir", err)
+			}
+			inode, err := f.fs.getInode(entry.inode)
+			if err != nil {
+				return err
 			}
+			f.directories = append(f.directories, exportedDirectory{inode, pathForMkdir})
+			f.fileDone()
 		} else if entry.filetype == EXT4_FT_REG_FILE || entry.filetype == EXT4_FT_SYMLINK {
-			f.exportInode(entry.inode, pathForMkdir)
+			linked, err := f.linkExportedInode(entry.inode, pathForMkdir)
+			if err != nil || linked {
+				return err
+			}
+			if err := f.exportInode(entry.inode, pathForMkdir, imagePath); err != nil {
+				return err
+			}
+			f.fileDone()
+		} else if entry.filetype == EXT4_FT_CHRDEV || entry.filetype == EXT4_FT_BLKDEV ||
+			entry.filetype == EXT4_FT_FIFO || entry.filetype == EXT4_FT_SOCK {
+			linked, err := f.linkExportedInode(entry.inode, pathForMkdir)
+			if err != nil || linked {
+				return err
+			}
+			if err := f.exportSpecialInode(entry.inode, pathForMkdir, imagePath); err != nil {
+				return err
+			}
+			f.fileDone()
 		}
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if f.options.OrphanDir != "" {
+		if err := f.exportOrphans(); err != nil {
+			return err
+		}
+	}
+	if err := f.applyDirectoriesMetadata(); err != nil {
+		return err
+	}
+	f.reportProgress()
+	return nil
 }
 
-func (f *FsUnpacker) recurseDirs(inodeNumber uint32, path string, callback func(DirectoryEntry, string)) {
-	inodeTable := f.fs.getInode(inodeNumber)
+// applyDirectoriesMetadata sets owners, modes and times of the directories in post-order: every directory is
+// handled after its children, so writing them neither changes its mtime nor hits a read-only mode.
+func (f *FsUnpacker) applyDirectoriesMetadata() error {
+	for ind := len(f.directories) - 1; ind >= 0; ind-- {
+		dir := f.directories[ind]
+		if err := f.setOwner(dir.inode, dir.path); err != nil {
+			return err
+		}
+		if err := os.Chmod(dir.path, f.permissions(dir.inode)); err != nil {
+			return hostError("chmod", err)
+		}
+		if err := f.setTimeVal(dir.inode, dir.path); err != nil {
+			return err
+		}
+	}
+	f.directories = nil
+	return nil
+}
+
+// linkExportedInode creates a hard link to the already extracted copy of the inode, if there is one.
+func (f *FsUnpacker) linkExportedInode(inodeNumber uint32, currentPath string) (bool, error) {
+	if f.options.BreakHardLinks {
+		return false, nil
+	}
+	firstPath, ok := f.exportedInodes[inodeNumber]
+	if !ok {
+		return false, nil
+	}
+	if err := os.Link(firstPath, currentPath); err != nil {
+		return false, hostError("link", err)
+	}
+	return true, nil
+}
+
+// recurseDirs calls the callback for every entry of the directory tree, a directory goes before its content.
+// In salvage mode the damaged blocks and entries are skipped.
+func (f *FsUnpacker) recurseDirs(inodeNumber uint32, path string, callback func(DirectoryEntry, string) error) (err error) {
+	defer inodeContext(&err, inodeNumber, "/"+path)
+	inodeTable, err := f.fs.getInode(inodeNumber)
+	if err != nil {
+		return err
+	}
 	if (inodeTable.i_mode & 0xf000) != EXT4SIFDIR {
-		return
-	}
-	inodeTable.enumBlocks(f.fs.super, func(reader *MmapCustomReader) bool {
-		initialCursorPosition := reader.cursorPosition
-		currentReader := *reader
-		for currentReader.cursorPosition < initialCursorPosition+int64(f.fs.super.Blocksize()) {
-			var e DirectoryEntry
-			readerForDirectoryEntryParser := currentReader
-			e.parse(&readerForDirectoryEntryParser)
-			n := e.rec_len
-			currentReader.cursorPosition += int64(n)
-			if n == 0 {
-				break
-			}
-			if e.filetype == EXT4_FT_UNKNOWN {
-				continue
-			}
-			if e.name == "." || e.name == ".." {
-				continue
+		return nil
+	}
+	if f.walkedDirectories[inodeNumber] {
+		return newError("directory walk", ErrCorrupt, "the directory is linked more than once")
+	}
+	f.walkedDirectories[inodeNumber] = true
+	return inodeTable.enumRunsWithDamage(f.fs.super, func(run blockRun) error {
+		if run.damage != nil {
+			return f.salvage(inodeNumber, "/"+path, run.physical, DamageSkipped, run.damage)
+		}
+		if run.unwritten {
+			return nil
+		}
+		for n := uint64(0); n < run.length; n++ {
+			block := run.physical + n
+			reader, err := f.fs.super.GetBlock(block)
+			if err == nil {
+				err = f.fs.enumDirectoryBlock(reader, func(e DirectoryEntry) error {
+					// unused entries, the metadata_csum tail and the links to itself and the parent are skipped
+					if e.filetype != EXT4_FT_UNKNOWN && e.inode != 0 && e.name != "." && e.name != ".." {
+						return f.walkEntry(e, path, block, callback)
+					}
+					return nil
+				})
 			}
-			callback(e, path)
-			if e.filetype == EXT4_FT_DIR {
-				var pathForRecurse string
-				if path != "" {
-					pathForRecurse = path + "/" + e.name
-				} else {
-					pathForRecurse = e.name
-				}
-				f.recurseDirs(e.inode, pathForRecurse, callback)
+			if err := f.salvage(inodeNumber, "/"+path, block, DamageSkipped, err); err != nil {
+				return err
 			}
 		}
-		return true
+		return nil
 	})
 }
 
-func (f *FsUnpacker) exportInode(inodeNumber uint32, currentPath string) {
+// walkEntry passes the entry to the callback and goes into it if it's a directory.
+func (f *FsUnpacker) walkEntry(e DirectoryEntry, path string, block uint64, callback func(DirectoryEntry, string) error) error {
+	var pathForRecurse string
+	if path != "" {
+		pathForRecurse = path + "/" + e.name
+	} else {
+		pathForRecurse = e.name
+	}
 	var err error
-	inodeTable := f.fs.getInode(inodeNumber)
-	if inodeTable.emptyFlag {
-		return
+	if e.inode > f.fs.super.s_inodes_count {
+		err = newError("directory parse", ErrCorrupt, "block %d: entry %q refers to inode %d out of the filesystem",
+			block, e.name, e.inode)
+	} else if err = callback(e, path); err == nil && e.filetype == EXT4_FT_DIR {
+		err = f.recurseDirs(e.inode, pathForRecurse, callback)
+	}
+	return f.salvage(e.inode, "/"+pathForRecurse, block, DamageSkipped, err)
+}
+
+// exportInode writes the content of a regular file or a symlink. In salvage mode the blocks that can't be read
+// are left zero-filled.
+func (f *FsUnpacker) exportInode(inodeNumber uint32, currentPath string, imagePath string) (err error) {
+	defer inodeContext(&err, inodeNumber, imagePath)
+	inodeTable, err := f.fs.getInode(inodeNumber)
+	if err != nil || inodeTable.emptyFlag {
+		return err
 	}
 	file, err := os.OpenFile(currentPath, os.O_CREATE|os.O_WRONLY, os.FileMode(inodeTable.i_mode))
+	if err != nil {
+		return hostError("create", err)
+	}
 	defer file.Close()
+	blocksize := int64(f.fs.super.Blocksize())
+	err = inodeTable.enumRunsWithDamage(f.fs.super, func(run blockRun) error {
+		if run.damage != nil {
+			return f.salvage(inodeNumber, imagePath, run.physical, DamageZeroFilled, run.damage)
+		}
+		if run.unwritten {
+			return nil
+		}
+		for n := uint64(0); n < run.length; n++ {
+			if err := f.checkCanceled(); err != nil {
+				return err
+			}
+			data, err := f.fs.super.readBlock(run.physical + n)
+			if err != nil {
+				if err := f.salvage(inodeNumber, imagePath, run.physical+n, DamageZeroFilled, err); err != nil {
+					return err
+				}
+				continue
+			}
+			// holes and unwritten runs are skipped, they read as zeros
+			if _, err := file.WriteAt(data, int64(run.logical+n)*blocksize); err != nil {
+				return hostError("write", err)
+			}
+			f.bytesDone(uint64(blocksize))
+		}
+		return nil
+	})
 	if err != nil {
-		log.Panicf("exportInode: Failed to create file: %v", err)
+		return err
+	}
+	if err = file.Truncate(int64(inodeTable.datasize())); err != nil {
+		return hostError("truncate", err)
+	}
+	if err = f.setOwner(inodeTable, currentPath); err != nil {
+		return err
+	}
+	if err = file.Chmod(f.permissions(inodeTable)); err != nil {
+		return hostError("chmod", err)
+	}
+	if err = f.setTimeVal(inodeTable, currentPath); err != nil {
+		return err
+	}
+	if inodeTable.i_links_count > 1 {
+		f.exportedInodes[inodeNumber] = currentPath
 	}
-	inodeTable.enumBlocks(f.fs.super, func(reader *MmapCustomReader) bool {
-		_, err := file.Write(reader.ReadN(int64(f.fs.super.Blocksize())))
+	return nil
+}
+
+// exportSpecialInode creates a device node, FIFO or socket. If mknod isn't permitted, the node goes to the device table.
+func (f *FsUnpacker) exportSpecialInode(inodeNumber uint32, currentPath string, imagePath string) (err error) {
+	defer inodeContext(&err, inodeNumber, imagePath)
+	inodeTable, err := f.fs.getInode(inodeNumber)
+	if err != nil || inodeTable.emptyFlag {
+		return err
+	}
+	var major, minor uint32
+	if inodeTable.isDevice() {
+		major, minor = inodeTable.deviceNumber()
+	}
+	err = mknod(currentPath, uint32(inodeTable.i_mode), major, minor)
+	if errors.Is(err, fs.ErrPermission) {
+		return f.recordDevice(inodeTable, imagePath, major, minor)
+	}
+	if err != nil {
+		return hostError("mknod", err)
+	}
+	if err = f.setOwner(inodeTable, currentPath); err != nil {
+		return err
+	}
+	if err = os.Chmod(currentPath, f.permissions(inodeTable)); err != nil {
+		return hostError("chmod", err)
+	}
+	if err = f.setTimeVal(inodeTable, currentPath); err != nil {
+		return err
+	}
+	if inodeTable.i_links_count > 1 {
+		f.exportedInodes[inodeNumber] = currentPath
+	}
+	return nil
+}
+
+func (f *FsUnpacker) recordDevice(inode DefaultInodeTable, imagePath string, major uint32, minor uint32) error {
+	var nodeType string
+	switch inode.i_mode & 0xf000 {
+	case EXT4SIFCHR:
+		nodeType = "c"
+	case EXT4SIFBLK:
+		nodeType = "b"
+	case EXT4SIFIFO:
+		nodeType = "p"
+	case EXT4SIFSOCK:
+		nodeType = "s"
+	}
+	if f.deviceTable == nil {
+		path := f.options.DeviceTablePath
+		if path == "" {
+			path = filepath.Join(f.savePath, DefaultDeviceTableName)
+		}
+		var err error
+		f.deviceTable, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
-			log.Panicf("enumBlocks: Failed to write file: %v", err)
+			return hostError("device table", err)
 		}
-		return true
-	})
-	_, err = file.Seek(int64(inodeTable.datasize()), 0)
+		fmt.Fprintln(f.deviceTable, "# <name>\t<type>\t<mode>\t<uid>\t<gid>\t<major>\t<minor>\t<start>\t<inc>\t<count>")
+	}
+	_, err := fmt.Fprintf(f.deviceTable, "%s\t%s\t%o\t%d\t%d\t%d\t%d\t0\t0\t-\n",
+		imagePath, nodeType, inode.i_mode&07777, inode.uid(), inode.gid(), major, minor)
 	if err != nil {
-		log.Panicf("exportInode: Failed to seek file: %v", err)
+		return hostError("device table", err)
 	}
-	err = file.Truncate(int64(inodeTable.datasize()))
+	return nil
+}
+
+func (f *FsUnpacker) closeDeviceTable() error {
+	if f.deviceTable == nil {
+		return nil
+	}
+	err := f.deviceTable.Close()
+	f.deviceTable = nil
+	if err != nil {
+		return hostError("device table", err)
+	}
+	return nil
+}
+
+func (f *FsUnpacker) recordMetadata(inodeNumber uint32, imagePath string) error {
+	inode, err := f.fs.getInode(inodeNumber)
 	if err != nil {
-		log.Panicf("exportInode: Failed to truncate file: %v", err)
+		return err
 	}
-	err = file.Chmod(os.FileMode(inodeTable.i_mode))
+	record, err := f.fs.newMetadataRecord(inodeNumber, inode, imagePath)
 	if err != nil {
-		log.Panicf("exportInode: Failed to chmod file: %v", err)
+		return err
+	}
+	return f.metadataDB.write(record)
+}
+
+func (f *FsUnpacker) setOwner(inode DefaultInodeTable, path string) error {
+	if !f.options.RestoreOwnership || os.Geteuid() != 0 {
+		return nil
+	}
+	uid := mapID(f.options.UIDMap, inode.uid())
+	gid := mapID(f.options.GIDMap, inode.gid())
+	if err := os.Lchown(path, int(uid), int(gid)); err != nil {
+		return hostError("chown", err)
 	}
-	f.setTimeVal(inodeTable, currentPath)
+	return nil
 }
 
-func (f *FsUnpacker) setTimeVal(inode DefaultInodeTable, path string) {
-	atime := time.Unix(int64(inode.i_atime), 0)
-	mtime := time.Unix(int64(inode.i_mtime), 0)
-	err := os.Chtimes(path, atime, mtime)
+// permissions converts the permission, setuid, setgid and sticky bits of i_mode to os.FileMode with Umask applied.
+func (f *FsUnpacker) permissions(inode DefaultInodeTable) os.FileMode {
+	mode := os.FileMode(inode.i_mode&0777) &^ f.options.Umask
+	if inode.i_mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if inode.i_mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if inode.i_mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func (f *FsUnpacker) setTimeVal(inode DefaultInodeTable, path string) error {
+	err := os.Chtimes(path, inode.atime(), inode.mtime())
 	if err != nil {
-		log.Panicf("setTimeVal: Failed to chtimes: %v", err)
+		return hostError("chtimes", err)
 	}
+	return nil
+}
+
+// Unpack extracts the image at targetPath to pathForExtracting with the default options.
+func Unpack(targetPath string, pathForExtracting string) error {
+	return UnpackWithOptions(targetPath, pathForExtracting, UnpackOptions{})
+}
+
+// UnpackWithOptions extracts the image at targetPath to pathForExtracting. It stops at the first error,
+// what has been extracted before stays on the disk.
+func UnpackWithOptions(targetPath string, pathForExtracting string, options UnpackOptions) error {
+	return UnpackContext(context.Background(), targetPath, pathForExtracting, options)
 }
 
-func Unpack(targetPath string, pathForExtracting string) {
-	file, err := mmap.New(mmap.NewReadOnly(targetPath))
+// UnpackContext is UnpackWithOptions that stops when the context is done, the error then wraps ctx.Err().
+func UnpackContext(ctx context.Context, targetPath string, pathForExtracting string, options UnpackOptions) (err error) {
+	fs, err := Open(targetPath, options.Options)
 	if err != nil {
-		log.Panicf("extfs Unpack: %v", err)
+		return err
 	}
-	fs := ExtFileSystem{superBlockOffset: 0x400}
-	reader := MmapCustomReader{mmapInstance: file}
-	fs.parse(reader)
-	unpacker := FsUnpacker{fs: fs, savePath: pathForExtracting}
-	unpacker.perform()
+	defer fs.Close()
+	unpacker := FsUnpacker{fs: fs, savePath: pathForExtracting, options: options, ctx: ctx}
+	return unpacker.perform()
 }
@@ -2,14 +2,23 @@ package extfs_test
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"extfs"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
+	"io"
 	"io/fs"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 )
 
 const pathForExtracting = "testExtracted"
@@ -84,7 +93,9 @@ func TestUnpack(t *testing.T) {
 	}
 	createDir(pathForExtracting)
 	for _, c := range cases {
-		extfs.Unpack(c.targetPath, pathForExtracting)
+		if err := extfs.Unpack(c.targetPath, pathForExtracting); err != nil {
+			t.Fatal(err)
+		}
 		currentPaths, currentSizes := getPathsAndSizes(pathForExtracting)
 		if !cmp.Equal(currentPaths, c.expectedPaths) {
 			t.Error(cmp.Diff(currentPaths, c.expectedPaths))
@@ -133,3 +144,1216 @@ func parsePtsFile(t *testing.T, path string) (filenames []string, sizes []int64)
 
 	return
 }
+
+func TestUnpackHardLinks(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	if err := extfs.Unpack("testImg/hardLinksExt2.img", pathForExtracting); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := os.Stat(pathForExtracting + "/a.txt")
+	for _, p := range []string{"b.txt", "sub/c.txt"} {
+		current, err := os.Stat(pathForExtracting + "/" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(first, current) {
+			t.Errorf("%s is not a hard link to a.txt", p)
+		}
+	}
+	pruneDir(pathForExtracting)
+	if err := extfs.UnpackWithOptions("testImg/hardLinksExt2.img", pathForExtracting, extfs.UnpackOptions{BreakHardLinks: true}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ = os.Stat(pathForExtracting + "/a.txt")
+	current, _ := os.Stat(pathForExtracting + "/b.txt")
+	if os.SameFile(first, current) {
+		t.Error("b.txt is a hard link while BreakHardLinks is set")
+	}
+	if current.Size() != 15 {
+		t.Errorf("b.txt has size %d, expected 15", current.Size())
+	}
+}
+
+func TestUnpackSpecialFiles(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	if err := extfs.Unpack("testImg/devicesExt2.img", pathForExtracting); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() != 0 {
+		table, err := os.ReadFile(pathForExtracting + "/" + extfs.DefaultDeviceTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"/dev/null\tc\t620\t0\t0\t1\t3\t", "/dev/nvme\tb\t644\t0\t0\t259\t300\t"} {
+			if !strings.Contains(string(table), line) {
+				t.Errorf("device table has no %q line", line)
+			}
+		}
+		return
+	}
+	expectedModes := map[string]fs.FileMode{
+		"dev/null": fs.ModeDevice | fs.ModeCharDevice | 0620,
+		"dev/nvme": fs.ModeDevice | 0644,
+		"dev/fifo": fs.ModeNamedPipe | 0644,
+		"dev/sock": fs.ModeSocket | 0755,
+	}
+	for p, mode := range expectedModes {
+		fileInfo, err := os.Lstat(pathForExtracting + "/" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileInfo.Mode() != mode {
+			t.Errorf("%s has mode %v, expected %v", p, fileInfo.Mode(), mode)
+		}
+	}
+}
+
+func TestUnpackMetadataDB(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	dbPath := pathForExtracting + "/.metadata"
+	if err := extfs.UnpackWithOptions("testImg/metadataExt4.img", pathForExtracting, extfs.UnpackOptions{MetadataDBPath: dbPath}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records := make(map[string]extfs.MetadataRecord)
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var record extfs.MetadataRecord
+		if err = decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records[record.Path] = record
+	}
+	var paths []string
+	for p := range records {
+		paths = append(paths, p)
+	}
+	if len(paths) != 8 {
+		t.Errorf("unexpected paths in the database: %v", paths)
+	}
+	tool := records["/bin/tool"]
+	if tool.Mode != 0104755 || tool.ProjectID != 42 || tool.Mtime%1e9 != 123456789 {
+		t.Errorf("unexpected /bin/tool record: %+v", tool)
+	}
+	if string(tool.Xattrs["user.comment"]) != "hello" || len(tool.Xattrs["user.big"]) != 300 ||
+		string(tool.Xattrs["security.selinux"]) != "system_u:object_r:bin_t:s0" {
+		t.Errorf("unexpected /bin/tool xattrs: %v", tool.Xattrs)
+	}
+	tty := records["/dev/tty"]
+	if tty.Major != 5 || tty.Minor != 0 || tty.Uid != 1000 || tty.Gid != 1000 {
+		t.Errorf("unexpected /dev/tty record: %+v", tty)
+	}
+	if records["/bin/slow"].Symlink != strings.Repeat("x", 80) || records["/bin/fast"].Symlink != "tool" {
+		t.Error("symlink targets weren't recorded")
+	}
+}
+
+func TestUnpackDirectoriesMetadata(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	defer os.Chmod(pathForExtracting+"/ro/inner", 0755) // so that removeDir can go inside without root
+	defer os.Chmod(pathForExtracting+"/ro", 0755)
+	createDir(pathForExtracting)
+	if err := extfs.UnpackWithOptions("testImg/dirModesExt4.img", pathForExtracting, extfs.UnpackOptions{Umask: 002}); err != nil {
+		t.Fatal(err)
+	}
+	expectedModes := map[string]fs.FileMode{
+		"ro":       fs.ModeDir | 0555,
+		"ro/inner": fs.ModeDir | 0555,
+		"tmp":      fs.ModeDir | fs.ModeSticky | 0775,
+		"shared":   fs.ModeDir | fs.ModeSetgid | 0775,
+	}
+	for p, mode := range expectedModes {
+		fileInfo, err := os.Stat(pathForExtracting + "/" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileInfo.Mode() != mode {
+			t.Errorf("%s has mode %v, expected %v", p, fileInfo.Mode(), mode)
+		}
+	}
+	for _, p := range []string{"ro", "ro/inner"} {
+		fileInfo, _ := os.Stat(pathForExtracting + "/" + p)
+		if fileInfo.ModTime().UnixNano() != 0x5ccfdd59*1e9+123456789 {
+			t.Errorf("%s has mtime %v", p, fileInfo.ModTime())
+		}
+	}
+	content, err := os.ReadFile(pathForExtracting + "/ro/inner/f.txt")
+	if err != nil || string(content) != "x\n" {
+		t.Errorf("ro/inner/f.txt wasn't extracted: %v", err)
+	}
+}
+
+func TestReadJournal(t *testing.T) {
+	if journal, err := extfs.ReadJournal("testImg/ext2.img", extfs.Options{}); journal != nil || err != nil {
+		t.Error("ext2 image has no journal", err)
+	}
+	// the same transactions logged with the tag formats of 64bit csum v3, csum v3 without 64bit and csum v2
+	cases := []struct {
+		image       string
+		note, other uint64
+	}{
+		{"testImg/journalExt4.img", 1082, 1083},
+		{"testImg/journalCsumV3Ext4.img", 1066, 1067},
+		{"testImg/journalCsumV2Ext4.img", 1066, 1067},
+	}
+	for _, c := range cases {
+		journal, err := extfs.ReadJournal(c.image, extfs.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if journal.Start() != 1 || journal.Sequence() != 1 {
+			t.Errorf("%s: unexpected log start %d and sequence %d", c.image, journal.Start(), journal.Sequence())
+		}
+		var transactions []string
+		for _, transaction := range journal.Transactions() {
+			description := fmt.Sprintf("%d committed=%v", transaction.Sequence, transaction.Committed)
+			if transaction.BadChecksum || transaction.CommitTime.Year() != 2026 {
+				t.Errorf("%s: transaction %d has bad checksum %v, commit time %v", c.image, transaction.Sequence,
+					transaction.BadChecksum, transaction.CommitTime)
+			}
+			for _, block := range transaction.Blocks {
+				data, err := journal.BlockData(block)
+				if err != nil {
+					t.Fatal(err)
+				}
+				description += fmt.Sprintf(" %d:%q", block.FsBlock, strings.TrimRight(string(data), "\x00"))
+			}
+			for _, block := range transaction.Revoked {
+				description += fmt.Sprintf(" -%d", block)
+			}
+			transactions = append(transactions, description)
+		}
+		expected := []string{
+			fmt.Sprintf(`1 committed=true %d:"version 2\n"`, c.note),
+			fmt.Sprintf(`2 committed=true %d:"version 3\n" %d:"other v2\n"`, c.note, c.other),
+			fmt.Sprintf(`3 committed=true -%d`, c.other),
+		}
+		if !cmp.Equal(transactions, expected) {
+			t.Errorf("%s: %s", c.image, cmp.Diff(transactions, expected))
+		}
+		if err = journal.Close(); err != nil {
+			t.Error(err)
+		}
+		if _, err = journal.BlockData(journal.Transactions()[0].Blocks[0]); !errors.Is(err, extfs.ErrIO) {
+			t.Errorf("%s: the image is still readable after Close: %v", c.image, err)
+		}
+	}
+}
+
+func TestJournalChecksums(t *testing.T) {
+	// journalCsumV3Ext4 with a byte of the other.txt copy of transaction 2 and one of the commit block of 3 flipped
+	const image = "testImg/journalBadChecksumExt4.img"
+	journal, err := extfs.ReadJournal(image, extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	var badChecksums []string
+	for _, transaction := range journal.Transactions() {
+		description := fmt.Sprintf("%d:%v", transaction.Sequence, transaction.BadChecksum)
+		for _, block := range transaction.Blocks {
+			description += fmt.Sprintf(" %d:%v", block.FsBlock, block.BadChecksum)
+		}
+		badChecksums = append(badChecksums, description)
+	}
+	expected := []string{"1:false 1066:false", "2:true 1066:false 1067:true", "3:true"}
+	if !cmp.Equal(badChecksums, expected) {
+		t.Error(cmp.Diff(badChecksums, expected))
+	}
+	for _, sequence := range []uint32{2, 3} {
+		if _, err := extfs.Open(image, extfs.Options{AsOfTransaction: sequence}); !errors.Is(err, extfs.ErrCorrupt) {
+			t.Errorf("transaction %d was replayed: %v", sequence, err)
+		}
+	}
+	// the recovery stops before transaction 2
+	fs, err := extfs.Open(image, extfs.Options{ReplayJournal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if note, err := fs.ReadFile("/note.txt"); err != nil || string(note) != "version 2\n" {
+		t.Errorf("got %q: %v", note, err)
+	}
+}
+
+func TestUnpackReplayJournal(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	imageBefore, _ := os.ReadFile("testImg/journalExt4.img")
+	cases := []struct {
+		options       extfs.UnpackOptions
+		expectedNote  string
+		expectedOther string
+	}{
+		{extfs.UnpackOptions{}, "version 1\n", "other v1\n"},
+		// other.txt is revoked by the last transaction
+		{extfs.UnpackOptions{Options: extfs.Options{ReplayJournal: true}}, "version 3\n", "other v1\n"},
+		{extfs.UnpackOptions{Options: extfs.Options{AsOfTransaction: 1}}, "version 2\n", "other v1\n"},
+		{extfs.UnpackOptions{Options: extfs.Options{AsOfTransaction: 2}}, "version 3\n", "other v2\n"},
+	}
+	for _, c := range cases {
+		if err := extfs.UnpackWithOptions("testImg/journalExt4.img", pathForExtracting, c.options); err != nil {
+			t.Fatal(err)
+		}
+		note, _ := os.ReadFile(pathForExtracting + "/note.txt")
+		other, _ := os.ReadFile(pathForExtracting + "/other.txt")
+		if string(note) != c.expectedNote || string(other) != c.expectedOther {
+			t.Errorf("%+v: got %q and %q", c.options.Options, note, other)
+		}
+		pruneDir(pathForExtracting)
+	}
+	imageAfter, _ := os.ReadFile("testImg/journalExt4.img")
+	if !bytes.Equal(imageBefore, imageAfter) {
+		t.Error("the image was modified")
+	}
+
+	// a journal without checksums, where 1 and 2 are checkpointed and the log block of 1 is reused
+	const checkpointed = "testImg/journalCheckpointedExt4.img"
+	for _, sequence := range []uint32{1, 2} {
+		if _, err := extfs.Open(checkpointed, extfs.Options{AsOfTransaction: sequence}); !errors.Is(err, extfs.ErrInvalidOptions) {
+			t.Errorf("checkpointed transaction %d was replayed: %v", sequence, err)
+		}
+	}
+	filesystem, err := extfs.Open(checkpointed, extfs.Options{AsOfTransaction: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	note, _ := filesystem.ReadFile("/note.txt")
+	other, _ := filesystem.ReadFile("/other.txt")
+	if string(note) != "version 3\n" || string(other) != "other v2\n" {
+		t.Errorf("the checkpointed transactions were replayed: %q and %q", note, other)
+	}
+}
+
+func TestExternalJournal(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	options := extfs.Options{ExternalJournal: "testImg/externalJournal.img"}
+	journal, err := extfs.ReadJournal("testImg/externalJournalExt4.img", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	transactions := journal.Transactions()
+	if len(transactions) != 1 || len(transactions[0].Blocks) != 1 || transactions[0].Blocks[0].FsBlock != 33 {
+		t.Fatalf("unexpected transactions: %+v", transactions)
+	}
+	options.ReplayJournal = true
+	if err := extfs.UnpackWithOptions("testImg/externalJournalExt4.img", pathForExtracting, extfs.UnpackOptions{Options: options}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(pathForExtracting + "/e.txt")
+	if string(content) != "external v2\n" {
+		t.Errorf("the external journal wasn't replayed: %q", content)
+	}
+}
+
+func TestFastCommit(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	journal, err := extfs.ReadJournal("testImg/fastCommitExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	var tags []uint16
+	for _, tag := range journal.FastCommits() {
+		if tag.Tid != 2 {
+			t.Fatalf("unexpected fast commit tid: %+v", tag)
+		}
+		tags = append(tags, tag.Tag)
+	}
+	expectedTags := []uint16{extfs.EXT4_FC_TAG_INODE, extfs.EXT4_FC_TAG_ADD_RANGE, extfs.EXT4_FC_TAG_CREAT,
+		extfs.EXT4_FC_TAG_INODE, extfs.EXT4_FC_TAG_UNLINK}
+	if !cmp.Equal(tags, expectedTags) {
+		t.Fatalf("unexpected fast commit tags: %v", tags)
+	}
+	if creat := journal.FastCommits()[2]; creat.Parent != 2 || creat.Inode != 14 || creat.Name != "new.txt" {
+		t.Errorf("unexpected CREAT tag: %+v", creat)
+	}
+	if addRange := journal.FastCommits()[1]; addRange.Physical != 1100 || addRange.Length != 1 {
+		t.Errorf("unexpected ADD_RANGE tag: %+v", addRange)
+	}
+
+	options := extfs.UnpackOptions{Options: extfs.Options{ReplayJournal: true, ReplayFastCommit: true}}
+	if err := extfs.UnpackWithOptions("testImg/fastCommitExt4.img", pathForExtracting, options); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"keep.txt": "kept\n", "new.txt": "fast commit\n"}
+	for name, data := range expected {
+		content, _ := os.ReadFile(pathForExtracting + "/" + name)
+		if string(content) != data {
+			t.Errorf("%s: got %q, expected %q", name, content, data)
+		}
+	}
+	if _, err := os.Lstat(pathForExtracting + "/gone.txt"); err == nil {
+		t.Errorf("gone.txt is unlinked by the fast commit, but it was extracted")
+	}
+
+	// the same fast commit with a DEL_RANGE of the only block of keep.txt first, e2fsck leaves it without extents
+	pruneDir(pathForExtracting)
+	if err := extfs.UnpackWithOptions("testImg/fastCommitRangesExt4.img", pathForExtracting, options); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"keep.txt": "\x00\x00\x00\x00\x00", "new.txt": "fast commit\n"}
+	for name, data := range expected {
+		content, _ := os.ReadFile(pathForExtracting + "/" + name)
+		if string(content) != data {
+			t.Errorf("%s: got %q, expected %q after the range replay", name, content, data)
+		}
+	}
+
+	// the DEL_RANGE is of the resize inode, whose blocks are mapped indirectly: only its replay is skipped
+	filesystem, err := extfs.Open("testImg/fastCommitSkippedExt4.img", options.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	if skipped := filesystem.SkippedFastCommits(); len(skipped) != 1 || skipped[0].Inode != 7 ||
+		!errors.Is(skipped[0].Err, extfs.ErrUnsupportedFeature) {
+		t.Errorf("unexpected skipped fast commits: %+v", skipped)
+	}
+	expected = map[string]string{"keep.txt": "kept\n", "new.txt": "fast commit\n"}
+	for name, data := range expected {
+		if content, err := filesystem.ReadFile(name); string(content) != data || err != nil {
+			t.Errorf("%s: got %q, expected %q with a skipped inode: %v", name, content, data, err)
+		}
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	// 14 and 15 are on the s_last_orphan chain, 16 is in the orphan file
+	if orphans, err := extfs.ReadOrphans("testImg/orphansExt4.img", extfs.Options{}); !cmp.Equal(orphans, []uint32{14, 15, 16}) {
+		t.Errorf("unexpected orphans: %v, %v", orphans, err)
+	}
+	orphanDir := pathForExtracting + "/orphans"
+	if err := extfs.UnpackWithOptions("testImg/orphansExt4.img", pathForExtracting, extfs.UnpackOptions{OrphanDir: orphanDir}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"#14": "log1 data\n", "#15": "log2 data\n", "#16": "log3 data\n"}
+	entries, err := os.ReadDir(orphanDir)
+	if err != nil || len(entries) != len(expected) {
+		t.Fatalf("unexpected orphan directory content: %v, %v", entries, err)
+	}
+	for name, data := range expected {
+		content, _ := os.ReadFile(orphanDir + "/" + name)
+		if string(content) != data {
+			t.Errorf("%s: got %q, expected %q", name, content, data)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	quota, mismatches, err := extfs.ReadQuota("testImg/quotaExt4.img", extfs.Options{}, extfs.UserQuota)
+	if err != nil || quota == nil || len(quota.Entries) != 3 {
+		t.Fatalf("unexpected user quota: %+v, %v", quota, err)
+	}
+	expectedEntry := extfs.QuotaEntry{ID: 1000, QuotaUsage: extfs.QuotaUsage{Space: 8192, Inodes: 2},
+		BlockHardLimit: 100, BlockSoftLimit: 50, InodeHardLimit: 20, InodeSoftLimit: 10}
+	if !cmp.Equal(quota.Entries[1], expectedEntry) {
+		t.Errorf("unexpected quota entry: %+v", quota.Entries[1])
+	}
+	// the owner of /c was changed from 1001 to 1002 without updating the quota file
+	expectedMismatches := []extfs.QuotaMismatch{
+		{ID: 1001, Recorded: extfs.QuotaUsage{Space: 1024, Inodes: 1}},
+		{ID: 1002, Actual: extfs.QuotaUsage{Space: 1024, Inodes: 1}},
+	}
+	if !cmp.Equal(mismatches, expectedMismatches) {
+		t.Errorf("unexpected user quota mismatches: %+v", mismatches)
+	}
+	for _, quotaType := range []extfs.QuotaType{extfs.GroupQuota, extfs.ProjectQuota} {
+		quota, mismatches, err := extfs.ReadQuota("testImg/quotaExt4.img", extfs.Options{}, quotaType)
+		if err != nil || quota == nil || len(quota.Entries) != 2 || len(mismatches) != 0 {
+			t.Errorf("unexpected quota %d: %+v, mismatches: %+v, %v", quotaType, quota, mismatches, err)
+		}
+	}
+	// the id 0 entry has dqb_itime 1, the marker the kernel keeps it used with
+	quota, _, err = extfs.ReadQuota("testImg/quotaRootMarkerExt4.img", extfs.Options{}, extfs.UserQuota)
+	if err != nil || quota.Entries[0].ID != 0 || !quota.Entries[0].InodeGraceEnd.IsZero() {
+		t.Errorf("unexpected id 0 entry: %+v, %v", quota.Entries[0], err)
+	}
+}
+
+func TestReservedInodes(t *testing.T) {
+	reserved, err := extfs.ReadReservedInodes("testImg/reservedExt3.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodes := make(map[uint32]extfs.ReservedInode)
+	for _, inode := range reserved {
+		inodes[inode.Inode] = inode
+	}
+	if badBlocks := inodes[extfs.EXT2_BAD_INO].DataBlocks; !cmp.Equal(badBlocks, []uint64{3000, 3001, 3500}) {
+		t.Errorf("unexpected bad blocks: %v", badBlocks)
+	}
+	// the primary reserved GDT blocks 3-257 are the indirect blocks of the resize inode, the backups are its data
+	resize := inodes[extfs.EXT2_RESIZE_INO]
+	if len(resize.MetadataBlocks) != 256 || resize.MetadataBlocks[0] != 263 || resize.MetadataBlocks[1] != 3 ||
+		len(resize.DataBlocks) != 255*4 || resize.DataBlocks[0] != 515 || resize.DataBlocks[3] != 3587 {
+		t.Errorf("unexpected resize inode blocks: %v, %v", resize.MetadataBlocks, resize.DataBlocks)
+	}
+	journal := inodes[extfs.EXT2_JOURNAL_INO]
+	if !cmp.Equal(journal.MetadataBlocks, []uint64{276, 806, 807, 1068, 1325}) || len(journal.DataBlocks) != 1024 {
+		t.Errorf("unexpected journal inode blocks: %v, %d data blocks", journal.MetadataBlocks, len(journal.DataBlocks))
+	}
+	if inodes[extfs.EXT2_JOURNAL_INO].Name != "journal" || inodes[2].Name != "root directory" {
+		t.Errorf("unexpected reserved inode names: %+v", inodes)
+	}
+
+	filesystem, err := extfs.Open("testImg/reservedExt3.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	groups, err := filesystem.ReservedGDTBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary []string
+	for group := uint32(0); group < 8; group++ {
+		if blocks := groups[group]; len(blocks) != 0 {
+			summary = append(summary, fmt.Sprintf("%d:%d-%d", group, blocks[0], blocks[len(blocks)-1]))
+		}
+	}
+	if expected := []string{"0:3-257", "1:515-769", "3:1539-1793", "5:2563-2817", "7:3587-3841"}; !cmp.Equal(summary, expected) {
+		t.Errorf("unexpected reserved GDT blocks: %v", summary)
+	}
+	if blocks, err := filesystem.ExcludeBitmapBlocks(); blocks != nil || err != nil {
+		t.Errorf("the filesystem has no exclude bitmaps: %v, %v", blocks, err)
+	}
+	// the first backup listed by the primary reserved GDT block 3 is beyond the filesystem
+	damaged, err := extfs.Open("testImg/badResizeExt3.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer damaged.Close()
+	if _, err = damaged.ReservedGDTBlocks(); !errors.Is(err, extfs.ErrCorrupt) {
+		t.Errorf("unexpected error for a reserved GDT block out of the filesystem: %v", err)
+	}
+}
+
+func TestBackupSuperBlock(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	testCases := []struct {
+		image    string
+		options  extfs.Options
+		expected extfs.SuperBlockCopy
+	}{
+		// the primary superblock magic is wiped, the non-default geometry (-g 512) must be given
+		{"testImg/backupSuperBlockExt4.img", extfs.Options{BlocksPerGroup: 512},
+			extfs.SuperBlockCopy{Group: 1, Offset: 513 * 1024, Reason: "invalid superblock magic"}},
+		{"testImg/backupSuperBlockExt4.img", extfs.Options{SuperBlockGroup: 3, BlocksPerGroup: 512},
+			extfs.SuperBlockCopy{Group: 3, Offset: 1537 * 1024, Reason: "selected by the options"}},
+		// the primary descriptor of group 1 is damaged, the geometry comes from the primary superblock
+		{"testImg/backupDescriptorsExt4.img", extfs.Options{},
+			extfs.SuperBlockCopy{Group: 1, Offset: 513 * 1024, Reason: "descriptor checksum mismatch in group 1"}},
+		{"testImg/metadataExt4.img", extfs.Options{}, extfs.SuperBlockCopy{Offset: 1024}},
+	}
+	for _, testCase := range testCases {
+		used, err := extfs.ReadSuperBlockCopy(testCase.image, testCase.options)
+		if err != nil || !cmp.Equal(used, testCase.expected) {
+			t.Errorf("%s: got %+v, expected %+v, %v", testCase.image, used, testCase.expected, err)
+		}
+	}
+	createDir(pathForExtracting)
+	if err := extfs.UnpackWithOptions("testImg/backupSuperBlockExt4.img", pathForExtracting,
+		extfs.UnpackOptions{Options: extfs.Options{BlocksPerGroup: 512}}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(pathForExtracting + "/hello.txt")
+	if string(content) != "backup\n" {
+		t.Errorf("unexpected content read with the backup superblock: %q", content)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	features, err := extfs.ReadFeatures("testImg/inlineDataExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dumpe2fs listing
+	expected := strings.Fields("ext_attr resize_inode dir_index filetype extent 64bit flex_bg inline_data sparse_super " +
+		"large_file huge_file dir_nlink extra_isize metadata_csum")
+	if !cmp.Equal(features.Names(), expected) || !features.Has("inline_data") || features.Has("has_journal") {
+		t.Errorf("unexpected features: %v", features.Names())
+	}
+	if unsupported := features.Unsupported(); !cmp.Equal(unsupported, []string{"inline_data"}) {
+		t.Errorf("unexpected unsupported features: %v", unsupported)
+	}
+	if _, err = extfs.ReadReservedInodes("testImg/metadataExt4.img", extfs.Options{}); err != nil {
+		t.Error(err)
+	}
+	if _, err = extfs.ReadReservedInodes("testImg/inlineDataExt4.img", extfs.Options{}); !errors.Is(err, extfs.ErrUnsupportedFeature) {
+		t.Errorf("an image with unsupported incompat features was parsed: %v", err)
+	}
+	if _, err = extfs.ReadReservedInodes("testImg/inlineDataExt4.img", extfs.Options{PermissiveFeatures: true}); err != nil {
+		t.Error(err)
+	}
+	filesystem, err := extfs.Open("testImg/inlineDataExt4.img", extfs.Options{PermissiveFeatures: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	if unsupported := filesystem.Features().Unsupported(); !cmp.Equal(unsupported, []string{"inline_data"}) {
+		t.Errorf("the unsupported features of the opened filesystem: %v", unsupported)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	// the extent header magic of /bin/tool (inode 15) is wiped
+	err := extfs.Unpack("testImg/corruptExtentExt4.img", pathForExtracting)
+	var extfsError *extfs.Error
+	if !errors.Is(err, extfs.ErrCorruptExtent) || !errors.As(err, &extfsError) ||
+		extfsError.Inode != 15 || extfsError.Path != "/bin/tool" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// the second leaf of /fragmented.bin (inode 13) is turned into an index whose entry points to its own block
+	pruneDir(pathForExtracting)
+	err = extfs.Unpack("testImg/loopExtentExt4.img", pathForExtracting)
+	if !errors.Is(err, extfs.ErrCorruptExtent) || !errors.As(err, &extfsError) || extfsError.Inode != 13 {
+		t.Errorf("unexpected error for a looping extent tree: %v", err)
+	}
+	filesystem, err := extfs.Open("testImg/loopExtentExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	if _, err = filesystem.FileMapping("/fragmented.bin"); !errors.Is(err, extfs.ErrCorruptExtent) {
+		t.Errorf("unexpected mapping error for a looping extent tree: %v", err)
+	}
+	if _, err = filesystem.ReadFile("/fragmented.bin"); !errors.Is(err, extfs.ErrCorruptExtent) {
+		t.Errorf("unexpected read error for a looping extent tree: %v", err)
+	}
+	pruneDir(pathForExtracting)
+	report, err := extfs.Salvage("testImg/loopExtentExt4.img", pathForExtracting, extfs.UnpackOptions{})
+	if err != nil || len(report.Damages) != 1 || report.Damages[0].Inode != 13 ||
+		!errors.Is(report.Damages[0].Err, extfs.ErrCorruptExtent) {
+		t.Errorf("unexpected salvage of a looping extent tree: %+v, %v", report, err)
+	}
+	if _, err = extfs.ReadFeatures("testImg/FWInExt4.pts", extfs.Options{}); !errors.Is(err, extfs.ErrBadMagic) {
+		t.Errorf("unexpected error for a non-ext image: %v", err)
+	}
+	if _, err = extfs.ReadFeatures("testImg/missing.img", extfs.Options{}); !errors.Is(err, extfs.ErrIO) ||
+		!errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("unexpected error for a missing image: %v", err)
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	if err := extfs.Unpack("testImg/salvageExt4.img", pathForExtracting); !errors.Is(err, extfs.ErrCorrupt) {
+		t.Errorf("the damaged image was extracted without salvage: %v", err)
+	}
+	pruneDir(pathForExtracting)
+	report, err := extfs.Salvage("testImg/salvageExt4.img", pathForExtracting, extfs.UnpackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type damage struct {
+		Inode  uint32
+		Path   string
+		Block  uint64
+		Action extfs.DamageAction
+	}
+	var damages []damage
+	for _, d := range report.Damages {
+		damages = append(damages, damage{d.Inode, d.Path, d.Block, d.Action})
+	}
+	expected := []damage{
+		{60000, "/lost+found", 7, extfs.DamageSkipped}, // the entry refers to an inode out of the filesystem
+		{12, "/bad.txt", 7, extfs.DamageSkipped},       // the extent header magic is wiped
+		{13, "/dir", 21, extfs.DamageSkipped},          // c.txt has an invalid rec_len
+		{17, "/index.txt", 77777, extfs.DamageZeroFilled},
+		{18, "/multi.txt", 99999, extfs.DamageZeroFilled},
+		{18, "/multi.txt", 100000, extfs.DamageZeroFilled},
+		{20, "/zero.txt", 100000, extfs.DamageZeroFilled},
+	}
+	if !cmp.Equal(damages, expected) {
+		t.Error(cmp.Diff(damages, expected))
+	}
+	if !errors.Is(report.Damages[1].Err, extfs.ErrCorruptExtent) || !errors.Is(report.Damages[3].Err, extfs.ErrBlockOutOfRange) {
+		t.Errorf("unexpected damage errors: %v, %v", report.Damages[1].Err, report.Damages[3].Err)
+	}
+	expectedContent := map[string]string{
+		"ok.txt":    "intact\n",
+		"dir/a.txt": "first\n",
+		"dir/b.txt": "second\n",
+		"index.txt": strings.Repeat("\x00", 6),
+		"zero.txt":  strings.Repeat("\x00", 4),
+		"multi.txt": strings.Repeat("B", 1024) + strings.Repeat("\x00", 3000-1024),
+	}
+	for name, data := range expectedContent {
+		content, err := os.ReadFile(pathForExtracting + "/" + name)
+		if err != nil || string(content) != data {
+			t.Errorf("%s: got %d bytes %.20q, %v", name, len(content), content, err)
+		}
+	}
+	for _, name := range []string{"bad.txt", "dir/c.txt", "lost+found"} {
+		if _, err := os.Lstat(pathForExtracting + "/" + name); err == nil {
+			t.Errorf("the damaged %s was extracted", name)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	filesystem, err := extfs.Open("testImg/metadataExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := filesystem.Info()
+	if info.BlockSize != 1024 || info.BlocksCount != 256 || info.FreeBlocksCount != 223 || info.InodesCount != 32 ||
+		info.MaxMountCount != -1 || fmt.Sprintf("%x", info.UUID[:4]) != "90fca1d1" || !info.Features.Has("metadata_csum") {
+		t.Errorf("unexpected superblock info: %+v", info)
+	}
+	if inodeNumber, err := filesystem.Lookup("/bin/tool"); inodeNumber != 15 || err != nil {
+		t.Errorf("/bin/tool is inode %d, %v", inodeNumber, err)
+	}
+	if _, err = filesystem.Lookup("/bin/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("unexpected error for a missing file: %v", err)
+	}
+	if _, err = filesystem.Lookup("/bin/tool/x"); !errors.Is(err, extfs.ErrNotDir) {
+		t.Errorf("unexpected error for a file in place of a directory: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if data, err := filesystem.ReadFile("bin/tool"); string(data) != "tool\n" || err != nil {
+			t.Errorf("unexpected /bin/tool content: %q, %v", data, err)
+		}
+	}
+	if err = filesystem.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = filesystem.ReadFile("/bin/tool"); !errors.Is(err, extfs.ErrIO) {
+		t.Errorf("the image was read after Close: %v", err)
+	}
+	// hardLinksExt2 in the partition starting at sector 63 of a disk image
+	const partition = "testImg/partitionExt2.img"
+	if _, err = extfs.Open(partition, extfs.Options{}); !errors.Is(err, extfs.ErrBadMagic) {
+		t.Errorf("the disk image was read as a filesystem: %v", err)
+	}
+	for _, offset := range []int64{-1, 1 << 20} {
+		if _, err = extfs.Open(partition, extfs.Options{ImageOffset: offset}); !errors.Is(err, extfs.ErrInvalidOptions) {
+			t.Errorf("unexpected error for the offset %d: %v", offset, err)
+		}
+	}
+	filesystem, err = extfs.Open(partition, extfs.Options{ImageOffset: 63 * 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	if err = fstest.TestFS(filesystem.FS(), "a.txt", "b.txt", "sub/c.txt", "sub/d.txt"); err != nil {
+		t.Error(err)
+	}
+	if superBlockCopy := filesystem.SuperBlockCopy(); superBlockCopy.Offset != 0x400 {
+		t.Errorf("the superblock offset %d isn't relative to the partition", superBlockCopy.Offset)
+	}
+}
+
+func TestFS(t *testing.T) {
+	filesystem, err := extfs.Open("testImg/hardLinksExt2.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	// fs.FS users like http.FileServer share one view between goroutines
+	var testers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		testers.Add(1)
+		go func() {
+			defer testers.Done()
+			if err := fstest.TestFS(filesystem.FS(), "a.txt", "b.txt", "sub/c.txt", "sub/d.txt"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	testers.Wait()
+
+	// the root lists /lost+found, whose entry refers to an inode out of the filesystem
+	filesystem, err = extfs.Open("testImg/salvageExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	entries, err := filesystem.FS().ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := slices.IndexFunc(entries, func(entry fs.DirEntry) bool { return entry.Name() == "lost+found" })
+	if damaged < 0 {
+		t.Fatalf("lost+found isn't listed: %v", entries)
+	}
+	if _, err = entries[damaged].Info(); !entries[damaged].IsDir() || !errors.Is(err, extfs.ErrInodeOutOfRange) {
+		t.Errorf("unexpected damaged entry: %v, %v", entries[damaged], err)
+	}
+
+	filesystem, err = extfs.Open("testImg/metadataExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	fsys := filesystem.FS()
+	info, err := fsys.Stat("bin/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode := info.Sys().(*extfs.Inode); info.Name() != "fast" || info.Mode() != fs.ModeSetuid|0755 ||
+		info.Size() != 5 || inode.Number != 15 || inode.Mtime.Year() != 2020 {
+		t.Errorf("unexpected stat of the symlink target: %v %v %d %+v", info.Name(), info.Mode(), info.Size(), inode)
+	}
+	if info, err = fsys.Lstat("bin/fast"); err != nil || info.Mode() != fs.ModeSymlink|0777 {
+		t.Errorf("unexpected lstat of the symlink: %v, %v", info, err)
+	}
+	if target, err := fsys.ReadLink("bin/fast"); target != "tool" || err != nil {
+		t.Errorf("unexpected symlink target: %q, %v", target, err)
+	}
+	if data, err := fs.ReadFile(fsys, "bin/fast"); string(data) != "tool\n" || err != nil {
+		t.Errorf("unexpected content read through the symlink: %q, %v", data, err)
+	}
+	if info, err = fsys.Stat("dev/tty"); err != nil {
+		t.Fatal(err)
+	}
+	if inode := info.Sys().(*extfs.Inode); info.Mode() != fs.ModeDevice|fs.ModeCharDevice|0644 || inode.Major != 5 || inode.Minor != 0 ||
+		inode.Uid != 1000 || inode.Gid != 1000 {
+		t.Errorf("unexpected stat of the device: %v %+v", info.Mode(), inode)
+	}
+	if _, err = fsys.Open("bin/slow"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("unexpected error for a dangling symlink: %v", err)
+	}
+	if _, err = fsys.Open("/bin/tool"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("unexpected error for a rooted name: %v", err)
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	pattern := func(tag string, n int) string { return strings.Repeat(tag, n/len(tag)+1)[:n] }
+	for _, image := range []string{"testImg/sparseExt2.img", "testImg/sparseExt4.img"} {
+		filesystem, err := extfs.Open(image, extfs.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer filesystem.Close()
+		// the data are behind the direct, double-indirect and triple-indirect blocks of ext2
+		reader, err := filesystem.OpenFile("/big.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.Size() != (12+256+65536+10)*1024+7+3000 {
+			t.Errorf("%s: unexpected size %d", image, reader.Size())
+		}
+		for _, chunk := range []struct {
+			offset int64
+			data   string
+		}{
+			{0, pattern("head", 5000)},
+			{5000, strings.Repeat("\x00", 1000)},
+			{(12+256+1000)*1024 + 100, pattern("double", 3000)},
+			{(12+256+65536+10)*1024 + 7, pattern("triple", 3000)},
+		} {
+			buf := make([]byte, len(chunk.data))
+			if n, err := reader.ReadAt(buf, chunk.offset); n != len(buf) || string(buf) != chunk.data ||
+				err != nil && err != io.EOF {
+				t.Errorf("%s: unexpected data at %d: %d, %v", image, chunk.offset, n, err)
+			}
+		}
+		if n, err := reader.ReadAt(make([]byte, 10), reader.Size()-4); n != 4 || err != io.EOF {
+			t.Errorf("%s: unexpected read past the end: %d, %v", image, n, err)
+		}
+		// every other block is written, the extent tree of ext4 has a level of index nodes
+		reader, err = filesystem.OpenFile("/fragmented.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []byte
+		for block := 0; block < 401; block++ {
+			if block%2 == 0 && block < 400 {
+				expected = append(expected, pattern(fmt.Sprintf("%04d", block), 1024)...)
+			} else {
+				expected = append(expected, make([]byte, 1024)...)
+			}
+		}
+		if err = iotest.TestReader(reader, expected); err != nil {
+			t.Errorf("%s: %v", image, err)
+		}
+		// concurrent Reads share the offset, every block is read exactly once
+		if _, err = reader.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		chunks := make(chan string, 401)
+		var readers sync.WaitGroup
+		for n := 0; n < 4; n++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for {
+					chunk := make([]byte, 1024)
+					if n, _ := reader.Read(chunk); n != len(chunk) {
+						return
+					}
+					chunks <- string(chunk)
+				}
+			}()
+		}
+		readers.Wait()
+		close(chunks)
+		counts, expectedCounts := make(map[string]int), make(map[string]int)
+		for chunk := range chunks {
+			counts[chunk]++
+		}
+		for block := 0; block < 401; block++ {
+			expectedCounts[string(expected[block*1024:(block+1)*1024])]++
+		}
+		if !cmp.Equal(counts, expectedCounts) {
+			t.Errorf("%s: concurrent Reads got %d distinct chunks, expected %d", image, len(counts), len(expectedCounts))
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	filesystem, err := extfs.Open("testImg/symlinksExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	passwd, err := filesystem.Lookup("/etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// absolute and relative targets, a symlinked directory, ".." at the root and a chain of symlinks
+	for _, path := range []string{"/abs", "/etc/rel", "/dirlink/passwd", "/escape", "/chain1", "dirlink/../etc/passwd"} {
+		if inodeNumber, err := filesystem.Lookup(path); inodeNumber != passwd || err != nil {
+			t.Errorf("%s is inode %d, %v, want %d", path, inodeNumber, err, passwd)
+		}
+	}
+	if data, err := filesystem.ReadFile("/chain1"); string(data) != "root:x:0:0\n" || err != nil {
+		t.Errorf("unexpected content read through the symlinks: %q, %v", data, err)
+	}
+	if inode, err := filesystem.Lstat("/dirlink"); err != nil || inode.FileMode() != fs.ModeSymlink|0777 || inode.Symlink != "etc" {
+		t.Errorf("unexpected lstat of the symlink: %+v, %v", inode, err)
+	}
+	if inode, err := filesystem.Stat("/dirlink"); err != nil || !inode.FileMode().IsDir() {
+		t.Errorf("unexpected stat of the symlinked directory: %+v, %v", inode, err)
+	}
+	if _, err = filesystem.Lookup("/loop1"); !errors.Is(err, extfs.ErrSymlinkLoop) {
+		t.Errorf("unexpected error for a symlink loop: %v", err)
+	}
+	if _, err = filesystem.Lstat("/loop1"); err != nil {
+		t.Errorf("lstat followed the symlink: %v", err)
+	}
+	for maxSymlinks, expected := range map[int]error{3: extfs.ErrSymlinkLoop, 4: nil} {
+		limited, err := extfs.Open("testImg/symlinksExt4.img", extfs.Options{MaxSymlinks: maxSymlinks})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = limited.Lookup("/chain1"); !errors.Is(err, expected) {
+			t.Errorf("unexpected error with %d symlinks at most: %v", maxSymlinks, err)
+		}
+		limited.Close()
+	}
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	filesystem, err := extfs.Open("testImg/symlinksExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	// every goroutine walks the whole tree, reads the files and resolves the symlinks of one handle
+	walk := func() (listing []string, err error) {
+		err = fs.WalkDir(filesystem.FS(), ".", func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			line := fmt.Sprintf("%s %v", name, entry.Type())
+			if entry.Type().IsRegular() {
+				data, err := filesystem.ReadFile(name)
+				if err != nil {
+					return err
+				}
+				line += fmt.Sprintf(" %q", data)
+			}
+			if inodeNumber, err := filesystem.Lookup("/chain1"); err != nil {
+				return err
+			} else {
+				line += fmt.Sprintf(" %d", inodeNumber)
+			}
+			listing = append(listing, line)
+			return nil
+		})
+		return
+	}
+	expected, err := walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var walkers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		walkers.Add(1)
+		go func() {
+			defer walkers.Done()
+			for n := 0; n < 20; n++ {
+				listing, err := walk()
+				if err != nil || !cmp.Equal(listing, expected) {
+					t.Errorf("concurrent walk: %v\n%s", err, cmp.Diff(listing, expected))
+					return
+				}
+			}
+		}()
+	}
+	walkers.Wait()
+}
+
+func TestInodes(t *testing.T) {
+	filesystem, err := extfs.Open("testImg/deletedExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	if inode, err := filesystem.Inode(13); err != nil || !inode.Allocated || inode.Size != 5 {
+		t.Errorf("unexpected inode 13: %+v, %v", inode, err)
+	}
+	for _, inodeNumber := range []uint32{0, 33} {
+		if _, err = filesystem.Inode(inodeNumber); !errors.Is(err, extfs.ErrInodeOutOfRange) {
+			t.Errorf("unexpected error for inode %d: %v", inodeNumber, err)
+		}
+	}
+	// deleted.txt (inode 12) is freed by debugfs rm, its inode keeps the mode, the size and the deletion time
+	for _, unallocated := range []bool{false, true} {
+		var allocated, free []uint32
+		err = filesystem.EnumInodes(unallocated, func(inode *extfs.Inode) bool {
+			if inode.Allocated {
+				allocated = append(allocated, inode.Number)
+			} else if inode.Mode == 0100644 && inode.Size == 8 && inode.Dtime != 0 {
+				free = append(free, inode.Number)
+			} else {
+				t.Errorf("unexpected unallocated inode: %+v", inode)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 13}, allocated); diff != "" {
+			t.Errorf("unexpected allocated inodes (-want +got):\n%s", diff)
+		}
+		if expected := map[bool][]uint32{false: nil, true: {12}}[unallocated]; !cmp.Equal(expected, free) {
+			t.Errorf("unexpected unallocated inodes %v with unallocated %v", free, unallocated)
+		}
+	}
+	visited := 0
+	if err = filesystem.EnumInodes(false, func(*extfs.Inode) bool { visited++; return visited < 3 }); err != nil || visited != 3 {
+		t.Errorf("the enumeration didn't stop: %d, %v", visited, err)
+	}
+	// the panics of the callbacks aren't taken for damaged metadata
+	func() {
+		defer func() {
+			if r := recover(); r != "callback" {
+				t.Errorf("unexpected panic %v", r)
+			}
+		}()
+		err = filesystem.EnumInodes(false, func(*extfs.Inode) bool { panic("callback") })
+		t.Errorf("the panic of the callback was turned into %v", err)
+	}()
+}
+
+func TestBitmaps(t *testing.T) {
+	// 4 groups of 1024 blocks in a flex group: the bitmaps and the tables of all of them are packed into group 0,
+	// groups 1 and 2 have BLOCK_UNINIT
+	filesystem, err := extfs.Open("testImg/flexBgExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	descriptors := filesystem.GroupDescriptors()
+	if len(descriptors) != 4 {
+		t.Fatalf("unexpected descriptors: %+v", descriptors)
+	}
+	if d := descriptors[1]; d.FlexGroup != 0 || d.FirstBlock != 1025 || d.BlockBitmap != 4 || d.InodeBitmap != 8 ||
+		d.InodeTable != 15 || d.InodeTableBlocks != 4 || d.FreeBlocksCount != 1022 || d.ItableUnused != 16 ||
+		d.Flags != extfs.EXT4_BG_INODE_UNINIT|extfs.EXT4_BG_BLOCK_UNINIT {
+		t.Errorf("unexpected descriptor of group 1: %+v", d)
+	}
+	if d := descriptors[3]; d.BlocksCount != 1023 || d.BlockBitmap != 6 {
+		t.Errorf("unexpected descriptor of group 3: %+v", d)
+	}
+	expected := [][]extfs.BlockRange{
+		{{Start: 1, Length: 44, Used: true}, {Start: 45, Length: 980}},
+		{{Start: 1025, Length: 2, Used: true}, {Start: 1027, Length: 1022}},
+		{{Start: 2049, Length: 1024}},
+		{{Start: 3073, Length: 2, Used: true}, {Start: 3075, Length: 1021}},
+	}
+	for group := range expected {
+		ranges, err := filesystem.BlockRanges(uint32(group))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected[group], ranges); diff != "" {
+			t.Errorf("unexpected ranges of group %d (-want +got):\n%s", group, diff)
+		}
+	}
+	for block, expected := range map[uint64]bool{0: true, 26: true, 45: false, 1026: true, 1027: false, 4095: false} {
+		if allocated, err := filesystem.BlockAllocated(block); allocated != expected || err != nil {
+			t.Errorf("block %d allocated: %v, %v", block, allocated, err)
+		}
+	}
+	if _, err = filesystem.BlockAllocated(4096); !errors.Is(err, extfs.ErrBlockOutOfRange) {
+		t.Errorf("unexpected error for a block out of the filesystem: %v", err)
+	}
+	if allocated, err := filesystem.InodeAllocated(12); !allocated || err != nil {
+		t.Errorf("inode 12 allocated: %v, %v", allocated, err)
+	}
+	if allocated, err := filesystem.InodeAllocated(17); allocated || err != nil {
+		t.Errorf("inode 17 allocated: %v, %v", allocated, err)
+	}
+	// the primary superblock
+	if data, err := filesystem.ReadBlock(1); err != nil || len(data) != 1024 || data[56] != 0x53 || data[57] != 0xef {
+		t.Errorf("unexpected block 1: %v", err)
+	}
+
+	// sparse_super2 without backups: group 1 has no superblock copy, its BLOCK_UNINIT bitmap is all free
+	filesystem, err = extfs.Open("testImg/sparseSuper2Ext4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	ranges, err := filesystem.BlockRanges(1)
+	if expected := []extfs.BlockRange{{1025, 1024, false}}; err != nil || !cmp.Equal(ranges, expected) {
+		t.Errorf("unexpected ranges of a sparse_super2 group: %+v, %v", ranges, err)
+	}
+
+	// the bits of bigalloc bitmaps are 16-block clusters
+	filesystem, err = extfs.Open("testImg/bigallocExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	if _, err = filesystem.BlockAllocated(100); !errors.Is(err, extfs.ErrUnsupportedFeature) {
+		t.Errorf("a bigalloc bitmap was read by blocks: %v", err)
+	}
+	if _, err = filesystem.BlockRanges(0); !errors.Is(err, extfs.ErrUnsupportedFeature) {
+		t.Errorf("a bigalloc bitmap was read by blocks: %v", err)
+	}
+	// with meta_bg, BLOCK_UNINIT groups 1 and 2 may hold descriptor blocks the bitmap would miss
+	filesystem, err = extfs.Open("testImg/metaBgExt4.img", extfs.Options{PermissiveFeatures: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	if _, err = filesystem.BlockRanges(0); err != nil {
+		t.Errorf("the bitmap of group 0 is on the disk: %v", err)
+	}
+	if _, err = filesystem.BlockRanges(1); !errors.Is(err, extfs.ErrUnsupportedFeature) {
+		t.Errorf("the bitmap of a meta_bg group was built: %v", err)
+	}
+}
+
+func TestMapping(t *testing.T) {
+	const k = 1024
+	hole, metadata := extfs.MappingHole, extfs.MappingMetadata
+	filesystem, err := extfs.Open("testImg/sparseExt2.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	// the same layout as debugfs shows: (0-4):34-38, (DIND):39, (IND):40, (1268-1271):41-44, (TIND):45,
+	// (DIND):46, (IND):47, (65814-65816):48-50
+	extents, err := filesystem.FileMapping("/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []extfs.MappingExtent{
+		{0, 34, 5 * k, 0},
+		{5 * k, 0, 263 * k, hole},
+		{268 * k, 39, k, metadata},
+		{268 * k, 0, 768 * k, hole},
+		{1036 * k, 40, k, metadata},
+		{1036 * k, 0, 232 * k, hole},
+		{1268 * k, 41, 4 * k, 0},
+		{1272 * k, 0, (65804 - 1272) * k, hole},
+		{65804 * k, 45, k, metadata},
+		{65804 * k, 46, k, metadata},
+		{65804 * k, 47, k, metadata},
+		{65804 * k, 0, 10 * k, hole},
+		{65814 * k, 48, 3 * k, 0},
+	}
+	if diff := cmp.Diff(expected, extents); diff != "" {
+		t.Errorf("unexpected mapping of a block-mapped file (-want +got):\n%s", diff)
+	}
+
+	filesystem, err = extfs.Open("testImg/sparseExt4.img", extfs.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	// every other block of 400 is written, the leaves are in the blocks 59, 140 and 224, the last 2 blocks are a hole
+	if extents, err = filesystem.FileMapping("/fragmented.bin"); err != nil {
+		t.Fatal(err)
+	}
+	var leaves []uint64
+	last := extents[len(extents)-1]
+	for n, extent := range extents[:len(extents)-1] {
+		if extent.Flags == metadata {
+			leaves = append(leaves, extent.Physical)
+		} else if expectedFlags := map[bool]extfs.MappingFlags{true: hole}[extent.Logical/k%2 == 1]; extent.Flags != expectedFlags ||
+			extent.Length != k || extent.Logical+extent.Length != extents[n+1].Logical {
+			t.Errorf("unexpected extent %d: %+v", n, extent)
+		}
+	}
+	if !cmp.Equal([]uint64{59, 140, 224}, leaves) || last != (extfs.MappingExtent{399 * k, 0, 2 * k, hole}) {
+		t.Errorf("unexpected mapping of an extent-mapped file: leaves %v, last %+v", leaves, last)
+	}
+
+	filesystem, err = extfs.Open("testImg/inlineDataExt4.img", extfs.Options{PermissiveFeatures: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.Close()
+	if extents, err = filesystem.FileMapping("/tiny.txt"); err != nil || !cmp.Equal(extents, []extfs.MappingExtent{{0, 0, 5, extfs.MappingInline}}) {
+		t.Errorf("unexpected mapping of inline data: %+v, %v", extents, err)
+	}
+}
+
+func TestUnpackProgress(t *testing.T) {
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	// b.txt and sub/c.txt are hard links to a.txt, they aren't counted again
+	var reports []extfs.Progress
+	options := extfs.UnpackOptions{Progress: func(progress extfs.Progress) { reports = append(reports, progress) }}
+	if err := extfs.UnpackContext(context.Background(), "testImg/hardLinksExt2.img", pathForExtracting, options); err != nil {
+		t.Fatal(err)
+	}
+	if last := reports[len(reports)-1]; last != (extfs.Progress{Files: 4, TotalFiles: 14, Bytes: 2048, TotalBytes: 30 * 1024}) {
+		t.Errorf("unexpected final progress: %+v", last)
+	}
+	if len(reports) != 5 {
+		t.Errorf("unexpected progress reports: %+v", reports)
+	}
+
+	pruneDir(pathForExtracting)
+	ctx, cancel := context.WithCancel(context.Background())
+	reports = nil
+	options.Progress = func(progress extfs.Progress) {
+		reports = append(reports, progress)
+		cancel()
+	}
+	if err := extfs.UnpackContext(ctx, "testImg/hardLinksExt2.img", pathForExtracting, options); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error of a canceled extraction: %v", err)
+	}
+	if len(reports) != 1 || reports[0].Files != 1 {
+		t.Errorf("the extraction went on after the cancellation: %+v", reports)
+	}
+	if _, err := extfs.SalvageContext(ctx, "testImg/salvageExt4.img", pathForExtracting, extfs.UnpackOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error of a canceled salvage: %v", err)
+	}
+}
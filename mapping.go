@@ -0,0 +1,167 @@
+package extfs
+
+import "encoding/binary"
+
+const EXT4_INLINE_DATA_FL = 0x10000000
+
+// MappingFlags describe an entry of the mapping of a file.
+type MappingFlags uint32
+
+const (
+	MappingUnwritten MappingFlags = 1 << iota // preallocated blocks, they read as zeros
+	MappingHole                               // no blocks are allocated, Physical is zero
+	MappingInline                             // the data are kept in the inode itself, Physical is zero
+	MappingMetadata                           // an extent index or indirect block, Logical is the first byte it maps
+)
+
+// MappingExtent is an entry of the mapping of a file, like the ones FIEMAP returns.
+type MappingExtent struct {
+	Logical  uint64 // the offset inside the file in bytes
+	Physical uint64 // the first block on the disk
+	Length   uint64 // in bytes
+	Flags    MappingFlags
+}
+
+// Mapping returns where the data of the inode are on the disk, sorted by the logical offset. The holes up to
+// the size rounded up to blocks are listed, and so are the extent tree nodes and the indirect blocks, each
+// before the data it maps. Contiguous runs of data are merged.
+func (e *ExtFileSystem) Mapping(inodeNumber uint32) (extents []MappingExtent, err error) {
+	defer inodeContext(&err, inodeNumber, "")
+	inode, err := e.getInode(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	return e.mapping(inode)
+}
+
+// FileMapping is Mapping of the inode at the image path, the symlinks are followed as by Lookup.
+func (e *ExtFileSystem) FileMapping(path string) (extents []MappingExtent, err error) {
+	inodeNumber, err := e.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	defer inodeContext(&err, inodeNumber, path)
+	inode, err := e.getInode(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	return e.mapping(inode)
+}
+
+func (e *ExtFileSystem) mapping(inode DefaultInodeTable) (extents []MappingExtent, err error) {
+	size := inode.datasize()
+	if inode.isSymlink() || inode.i_flags&EXT4_INLINE_DATA_FL != 0 {
+		if size == 0 {
+			return nil, nil
+		}
+		return []MappingExtent{{Length: size, Flags: MappingInline}}, nil
+	}
+	blocksize := e.super.Blocksize()
+	var next uint64 // the first block after the data mapped so far
+	addHole := func(end uint64) {
+		if end > next {
+			extents = append(extents, MappingExtent{Logical: next * blocksize, Length: (end - next) * blocksize, Flags: MappingHole})
+		}
+	}
+	err = inode.enumMapping(e.super, func(run blockRun, metadata bool) {
+		addHole(run.logical)
+		if metadata {
+			extents = append(extents, MappingExtent{Logical: run.logical * blocksize, Physical: run.physical,
+				Length: blocksize, Flags: MappingMetadata})
+			next = max(next, run.logical)
+			return
+		}
+		extent := MappingExtent{Logical: run.logical * blocksize, Physical: run.physical, Length: run.length * blocksize}
+		if run.unwritten {
+			extent.Flags = MappingUnwritten
+		}
+		// the block-mapped runs are single blocks, the contiguous ones are merged
+		if last := len(extents) - 1; last >= 0 && extents[last].Flags == extent.Flags &&
+			extents[last].Logical+extents[last].Length == extent.Logical &&
+			extents[last].Physical+extents[last].Length/blocksize == extent.Physical {
+			extents[last].Length += extent.Length
+		} else {
+			extents = append(extents, extent)
+		}
+		next = max(next, run.logical+run.length)
+	})
+	if err != nil {
+		return nil, err
+	}
+	addHole((size + blocksize - 1) / blocksize)
+	return extents, nil
+}
+
+// enumMapping calls the callback for every run of data blocks and every block that maps them, an extent tree
+// node or an indirect block, in the logical order. The metadata blocks come before the runs they map,
+// their run has the first logical block they map.
+func (i *DefaultInodeTable) enumMapping(super SuperBlock, callback func(run blockRun, metadata bool)) error {
+	if i.i_flags&EXT4EXTENTSFL != 0 {
+		return i.extent.enumMapping(super, callback)
+	}
+	nblocks := (i.datasize() + super.Blocksize() - 1) / super.Blocksize()
+	var logical uint64
+	for ind := 0; ind < 12 && logical < nblocks; ind++ {
+		if i.i_block[ind] != 0 {
+			callback(blockRun{logical: logical, physical: uint64(i.i_block[ind]), length: 1}, false)
+		}
+		logical++
+	}
+	for depth := 1; depth <= 3 && logical < nblocks; depth++ {
+		if err := i.enumIndirectMapping(super, i.i_block[11+depth], depth, &logical, nblocks, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *DefaultInodeTable) enumIndirectMapping(super SuperBlock, blockNumber uint32, depth int, logical *uint64,
+	nblocks uint64, callback func(run blockRun, metadata bool)) error {
+	pointers := super.Blocksize() / 4
+	span := uint64(1)
+	for d := 0; d < depth; d++ {
+		span *= pointers
+	}
+	if blockNumber == 0 {
+		*logical += span
+		return nil
+	}
+	callback(blockRun{logical: *logical, physical: uint64(blockNumber), length: 1}, true)
+	buf, err := super.readBlock(uint64(blockNumber))
+	if err != nil {
+		return err
+	}
+	for ind := uint64(0); ind < pointers && *logical < nblocks; ind++ {
+		pointer := binary.LittleEndian.Uint32(buf[ind*4:])
+		if depth > 1 {
+			if err := i.enumIndirectMapping(super, pointer, depth-1, logical, nblocks, callback); err != nil {
+				return err
+			}
+			continue
+		}
+		if pointer != 0 {
+			callback(blockRun{logical: *logical, physical: uint64(pointer), length: 1}, false)
+		}
+		*logical++
+	}
+	return nil
+}
+
+func (e *Extent) enumMapping(super SuperBlock, callback func(run blockRun, metadata bool)) error {
+	for _, node := range e.extents[:e.extHeader.entries] {
+		switch node := node.(type) {
+		case *ExtentLeaf:
+			callback(node.run(), false)
+		case *ExtentInternal:
+			callback(blockRun{logical: uint64(node.block), physical: node.leaf(), length: 1}, true)
+			child, err := node.child(super)
+			if err != nil {
+				return err
+			}
+			if err := child.enumMapping(super, callback); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
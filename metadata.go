@@ -0,0 +1,102 @@
+package extfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+)
+
+// MetadataRecord is a line of the metadata database written by FsUnpacker when
+// UnpackOptions.MetadataDBPath is set. It keeps everything that an unprivileged
+// extraction can't apply on disk, so the filesystem can be rebuilt exactly later.
+type MetadataRecord struct {
+	Path       string            `json:"path"` // absolute path inside the image
+	Inode      uint32            `json:"ino"`
+	Mode       uint16            `json:"mode"` // raw i_mode: the file type, setuid/setgid/sticky and permission bits
+	Uid        uint32            `json:"uid"`
+	Gid        uint32            `json:"gid"`
+	Links      uint16            `json:"nlink"`
+	Size       uint64            `json:"size"`
+	Major      uint32            `json:"major,omitempty"`
+	Minor      uint32            `json:"minor,omitempty"`
+	Atime      int64             `json:"atime_ns"`
+	Mtime      int64             `json:"mtime_ns"`
+	Ctime      int64             `json:"ctime_ns"`
+	Crtime     int64             `json:"crtime_ns,omitempty"`
+	Flags      uint32            `json:"flags"`
+	Generation uint32            `json:"generation"`
+	ProjectID  uint32            `json:"projid,omitempty"`
+	Symlink    string            `json:"symlink,omitempty"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"`
+}
+
+type metadataDB struct {
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func createMetadataDB(path string) (*metadataDB, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, hostError("metadata db", err)
+	}
+	writer := bufio.NewWriter(file)
+	return &metadataDB{file: file, writer: writer, encoder: json.NewEncoder(writer)}, nil
+}
+
+func (m *metadataDB) write(record MetadataRecord) error {
+	if err := m.encoder.Encode(record); err != nil {
+		return hostError("metadata db", err)
+	}
+	return nil
+}
+
+func (m *metadataDB) close() error {
+	flushErr := m.writer.Flush()
+	if err := m.file.Close(); flushErr == nil && err != nil {
+		flushErr = err
+	}
+	if flushErr != nil {
+		return hostError("metadata db", flushErr)
+	}
+	return nil
+}
+
+func (e *ExtFileSystem) newMetadataRecord(inodeNumber uint32, inode DefaultInodeTable, path string) (MetadataRecord, error) {
+	xattrs, err := e.getXattrs(inode)
+	if err != nil {
+		return MetadataRecord{}, err
+	}
+	record := MetadataRecord{
+		Path:       path,
+		Inode:      inodeNumber,
+		Mode:       inode.i_mode,
+		Uid:        inode.uid(),
+		Gid:        inode.gid(),
+		Links:      inode.i_links_count,
+		Size:       inode.datasize(),
+		Atime:      inode.atime().UnixNano(),
+		Mtime:      inode.mtime().UnixNano(),
+		Ctime:      inode.ctime().UnixNano(),
+		Flags:      inode.i_flags,
+		Generation: inode.i_generation,
+		ProjectID:  inode.i_projid,
+		Xattrs:     xattrs,
+	}
+	if inode.i_crtime != 0 || inode.i_crtime_extra != 0 {
+		record.Crtime = inode.crtime().UnixNano()
+	}
+	if inode.isDevice() {
+		record.Major, record.Minor = inode.deviceNumber()
+	}
+	if inode.i_mode&0xf000 == EXT4SIFLNK {
+		if record.Symlink, err = e.readLink(inode); err != nil {
+			return MetadataRecord{}, err
+		}
+	}
+	if len(record.Xattrs) == 0 {
+		record.Xattrs = nil
+	}
+	return record, nil
+}
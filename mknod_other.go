@@ -0,0 +1,9 @@
+//go:build !unix
+
+package extfs
+
+import "os"
+
+func mknod(path string, mode uint32, major uint32, minor uint32) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: os.ErrPermission}
+}
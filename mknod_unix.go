@@ -0,0 +1,10 @@
+//go:build unix
+
+package extfs
+
+import "golang.org/x/sys/unix"
+
+// mknod creates a special file. The mode uses the same S_IF* layout as i_mode.
+func mknod(path string, mode uint32, major uint32, minor uint32) error {
+	return unix.Mknod(path, mode, int(unix.Mkdev(major, minor)))
+}
@@ -0,0 +1,100 @@
+package extfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const EXT4_ORPHAN_BLOCK_MAGIC = 0x0b10ca04
+const EXT4_ORPHAN_BLOCK_TAIL_SIZE = 8 // ob_magic and ob_checksum
+
+// Orphans returns the inodes that were unlinked while still open: first the s_last_orphan chain
+// (linked through i_dtime), then the entries of the orphan file.
+func (e *ExtFileSystem) Orphans() (orphans []uint32, err error) {
+	return e.orphans()
+}
+
+func (e *ExtFileSystem) orphans() (orphans []uint32, err error) {
+	seen := make(map[uint32]bool)
+	for inodeNumber := e.super.s_last_orphan; inodeNumber != 0; {
+		if inodeNumber > e.super.s_inodes_count || seen[inodeNumber] {
+			break // a broken or looped chain
+		}
+		seen[inodeNumber] = true
+		orphans = append(orphans, inodeNumber)
+		inode, err := e.getInode(inodeNumber)
+		if err != nil {
+			return nil, err
+		}
+		inodeNumber = inode.i_dtime
+	}
+	if e.super.s_feature_compat&EXT4_FEATURE_COMPAT_ORPHAN_FILE == 0 || e.super.s_orphan_file_inum == 0 {
+		return orphans, nil
+	}
+	defer inodeContext(&err, e.super.s_orphan_file_inum, "")
+	blocksize := int(e.super.Blocksize())
+	orphanFile, err := e.getInode(e.super.s_orphan_file_inum)
+	if err != nil {
+		return nil, err
+	}
+	err = orphanFile.enumBlocks(e.super, func(reader *MmapCustomReader) error {
+		data := reader.ReadN(int64(blocksize))
+		if err := reader.Err(); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(data[blocksize-EXT4_ORPHAN_BLOCK_TAIL_SIZE:]) != EXT4_ORPHAN_BLOCK_MAGIC {
+			return nil
+		}
+		for pos := 0; pos < blocksize-EXT4_ORPHAN_BLOCK_TAIL_SIZE; pos += 4 {
+			inodeNumber := binary.LittleEndian.Uint32(data[pos:])
+			if inodeNumber != 0 && inodeNumber <= e.super.s_inodes_count && !seen[inodeNumber] {
+				seen[inodeNumber] = true
+				orphans = append(orphans, inodeNumber)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// ReadOrphans returns the orphan inodes of the image at targetPath, see ExtFileSystem.Orphans.
+func ReadOrphans(targetPath string, options Options) ([]uint32, error) {
+	fs, err := Open(targetPath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	return fs.Orphans()
+}
+
+// exportOrphans writes the content of the orphan files and symlinks to OrphanDir as #<inode number>,
+// the way e2fsck names the files it reconnects to lost+found.
+func (f *FsUnpacker) exportOrphans() error {
+	orphans, err := f.fs.orphans()
+	if err != nil || len(orphans) == 0 {
+		return err
+	}
+	if err := os.MkdirAll(f.options.OrphanDir, 0755); err != nil {
+		return hostError("mkdir", err)
+	}
+	for _, inodeNumber := range orphans {
+		inode, err := f.fs.getInode(inodeNumber)
+		if err != nil {
+			return err
+		}
+		mode := inode.i_mode & 0xf000
+		if mode != EXT4SIFREG && mode != EXT4SIFLNK {
+			continue
+		}
+		if err := f.exportInode(inodeNumber, filepath.Join(f.options.OrphanDir, fmt.Sprintf("#%d", inodeNumber)), ""); err != nil {
+			return err
+		}
+		f.fileDone()
+	}
+	return nil
+}
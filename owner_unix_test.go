@@ -0,0 +1,42 @@
+//go:build unix
+
+package extfs_test
+
+import (
+	"extfs"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestUnpackOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown requires root")
+	}
+	defer removeDir(pathForExtracting)
+	createDir(pathForExtracting)
+	options := extfs.UnpackOptions{
+		RestoreOwnership: true,
+		UIDMap:           []extfs.IDMapping{{ImageID: 0, HostID: 100000, Size: 65536}},
+		GIDMap:           []extfs.IDMapping{{ImageID: 0, HostID: 100000, Size: 65536}},
+	}
+	if err := extfs.UnpackWithOptions("testImg/ownersExt2.img", pathForExtracting, options); err != nil {
+		t.Fatal(err)
+	}
+	expectedOwners := map[string][2]uint32{
+		"home":          {101001, 101001},
+		"home/user.txt": {101000, 100100},
+		"root.txt":      {100000, 100000},
+		"big.txt":       {extfs.OverflowID, extfs.OverflowID}, // 70000:70001 is out of the mapped range
+	}
+	for p, owner := range expectedOwners {
+		fileInfo, err := os.Lstat(pathForExtracting + "/" + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := fileInfo.Sys().(*syscall.Stat_t)
+		if stat.Uid != owner[0] || stat.Gid != owner[1] {
+			t.Errorf("%s is owned by %d:%d, expected %d:%d", p, stat.Uid, stat.Gid, owner[0], owner[1])
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package extfs
+
+// progressStep is how many bytes of file data are written between the Progress calls inside a file.
+const progressStep = 1 << 20
+
+// Progress is what UnpackOptions.Progress gets. The totals come from the superblock: the used inodes and
+// the used blocks, so they include the reserved inodes and the metadata blocks and Files and Bytes stay below
+// them. Hard links to an extracted inode aren't counted again, holes aren't counted at all.
+type Progress struct {
+	Files      uint64 // the inodes extracted: files, directories, symlinks and nodes
+	TotalFiles uint64
+	Bytes      uint64 // the file data written, in whole blocks
+	TotalBytes uint64
+}
+
+func (f *FsUnpacker) startProgress() {
+	info := f.fs.Info()
+	f.progress = Progress{
+		TotalFiles: uint64(info.InodesCount - info.FreeInodesCount),
+		TotalBytes: (info.BlocksCount - info.FreeBlocksCount) * info.BlockSize,
+	}
+	f.reportedBytes = 0
+}
+
+// checkCanceled aborts the extraction when the context is done. Like the failures of the host filesystem,
+// it's never salvaged.
+func (f *FsUnpacker) checkCanceled() error {
+	if f.ctx == nil {
+		return nil
+	}
+	if err := f.ctx.Err(); err != nil {
+		return &Error{Op: "unpack", Err: err, host: true}
+	}
+	return nil
+}
+
+func (f *FsUnpacker) fileDone() {
+	f.progress.Files++
+	f.reportProgress()
+}
+
+func (f *FsUnpacker) bytesDone(n uint64) {
+	f.progress.Bytes += n
+	if f.progress.Bytes-f.reportedBytes >= progressStep {
+		f.reportProgress()
+	}
+}
+
+func (f *FsUnpacker) reportProgress() {
+	if f.options.Progress != nil {
+		f.reportedBytes = f.progress.Bytes
+		f.options.Progress(f.progress)
+	}
+}
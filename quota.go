@@ -0,0 +1,289 @@
+package extfs
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+const (
+	QUOTA_USER_MAGIC      = 0xd9c01f11
+	QUOTA_GROUP_MAGIC     = 0xd9c01927
+	QUOTA_PROJECT_MAGIC   = 0xd9c03f14
+	QUOTA_TREE_BLOCK_SIZE = 1024 // quota tree blocks don't depend on the filesystem blocksize
+	QUOTA_TREE_ROOT       = 1
+	QUOTA_TREE_DEPTH      = 4
+	QUOTA_INFO_OFFSET     = 8  // v2_disk_dqinfo follows the magic and the version
+	QUOTA_DATA_HEADER     = 16 // qt_disk_dqdbheader at the beginning of the data blocks
+	QUOTA_V2R0_ENTRY_SIZE = 48
+	QUOTA_V2R1_ENTRY_SIZE = 72
+	QUOTA_SPACE_UNIT      = 1024 // the block limits are kept in 1KiB units
+)
+
+const EXT4_HUGE_FILE_FL = 0x40000
+
+// QuotaType selects the quota file.
+type QuotaType int
+
+const (
+	UserQuota QuotaType = iota
+	GroupQuota
+	ProjectQuota
+)
+
+// QuotaUsage is what an id is charged for.
+type QuotaUsage struct {
+	Space  uint64 // bytes
+	Inodes uint64
+}
+
+// QuotaEntry is the usage and the limits of an id. Block limits are in 1KiB units, zero limits aren't enforced.
+type QuotaEntry struct {
+	ID uint32
+	QuotaUsage
+	BlockHardLimit uint64
+	BlockSoftLimit uint64
+	InodeHardLimit uint64
+	InodeSoftLimit uint64
+	BlockGraceEnd  time.Time // when the block soft limit turns into the hard one, zero if it isn't exceeded
+	InodeGraceEnd  time.Time
+}
+
+// Quota is a decoded v2 quota tree file.
+type Quota struct {
+	Type       QuotaType
+	Version    uint32
+	BlockGrace time.Duration
+	InodeGrace time.Duration
+	Entries    []QuotaEntry // ordered by ID
+}
+
+// QuotaMismatch is an id whose recorded usage differs from what the inode tables contain.
+type QuotaMismatch struct {
+	ID       uint32
+	Recorded QuotaUsage
+	Actual   QuotaUsage
+}
+
+func (e *ExtFileSystem) quotaInode(quotaType QuotaType) uint32 {
+	switch quotaType {
+	case UserQuota:
+		return e.super.s_usr_quota_inum
+	case GroupQuota:
+		return e.super.s_grp_quota_inum
+	case ProjectQuota:
+		return e.super.s_prj_quota_inum
+	}
+	return 0
+}
+
+// Quota decodes the quota file of the type. It returns nil if the filesystem has none.
+func (e *ExtFileSystem) Quota(quotaType QuotaType) (quota *Quota, err error) {
+	return e.quota(quotaType)
+}
+
+func (e *ExtFileSystem) quota(quotaType QuotaType) (quota *Quota, err error) {
+	inodeNumber := e.quotaInode(quotaType)
+	if inodeNumber == 0 {
+		return nil, nil
+	}
+	defer inodeContext(&err, inodeNumber, "")
+	inode, err := e.getInode(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	data, err := e.readInodeData(inode, inode.datasize())
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < QUOTA_INFO_OFFSET+24 {
+		return nil, newError("quota parse", ErrCorrupt, "the quota file is too small")
+	}
+	magic := binary.LittleEndian.Uint32(data)
+	if expected := [...]uint32{QUOTA_USER_MAGIC, QUOTA_GROUP_MAGIC, QUOTA_PROJECT_MAGIC}[quotaType]; magic != expected {
+		return nil, newError("quota parse", ErrBadMagic, "quota file: %#x", magic)
+	}
+	quota = &Quota{Type: quotaType, Version: binary.LittleEndian.Uint32(data[4:])}
+	info := data[QUOTA_INFO_OFFSET:]
+	quota.BlockGrace = time.Duration(binary.LittleEndian.Uint32(info)) * time.Second
+	quota.InodeGrace = time.Duration(binary.LittleEndian.Uint32(info[4:])) * time.Second
+	entrySize := QUOTA_V2R1_ENTRY_SIZE
+	switch quota.Version {
+	case 0:
+		entrySize = QUOTA_V2R0_ENTRY_SIZE
+	case 1:
+	default:
+		return nil, newError("quota parse", ErrCorrupt, "unknown quota format version %d", quota.Version)
+	}
+	visited := make(map[uint32]bool)
+	var walk func(block uint32, depth int)
+	walk = func(block uint32, depth int) {
+		if visited[block] || (uint64(block)+1)*QUOTA_TREE_BLOCK_SIZE > uint64(len(data)) {
+			return
+		}
+		visited[block] = true
+		buf := data[block*QUOTA_TREE_BLOCK_SIZE : (block+1)*QUOTA_TREE_BLOCK_SIZE]
+		if depth == QUOTA_TREE_DEPTH {
+			for pos := QUOTA_DATA_HEADER; pos+entrySize <= len(buf); pos += entrySize {
+				if entry, ok := parseQuotaEntry(buf[pos:pos+entrySize], quota.Version); ok {
+					quota.Entries = append(quota.Entries, entry)
+				}
+			}
+			return
+		}
+		for pos := 0; pos < len(buf); pos += 4 {
+			if ref := binary.LittleEndian.Uint32(buf[pos:]); ref != 0 {
+				walk(ref, depth+1)
+			}
+		}
+	}
+	walk(QUOTA_TREE_ROOT, 0)
+	sort.Slice(quota.Entries, func(a, b int) bool { return quota.Entries[a].ID < quota.Entries[b].ID })
+	return quota, nil
+}
+
+// parseQuotaEntry decodes v2_disk_dqblk (version 0) or v2r1_disk_dqblk (version 1). All-zero entries are free.
+// The kernel sets dqb_itime to 1 in the id 0 entry only to keep it from looking free, it's no grace time.
+func parseQuotaEntry(buf []byte, version uint32) (entry QuotaEntry, ok bool) {
+	for _, b := range buf {
+		if b != 0 {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return
+	}
+	graceEnd := func(sec uint64) time.Time {
+		if sec == 0 {
+			return time.Time{}
+		}
+		return time.Unix(int64(sec), 0)
+	}
+	entry.ID = binary.LittleEndian.Uint32(buf)
+	inodeGraceEnd := func(sec uint64) time.Time {
+		if entry.ID == 0 && sec == 1 {
+			sec = 0
+		}
+		return graceEnd(sec)
+	}
+	if version == 0 {
+		entry.InodeHardLimit = uint64(binary.LittleEndian.Uint32(buf[4:]))
+		entry.InodeSoftLimit = uint64(binary.LittleEndian.Uint32(buf[8:]))
+		entry.Inodes = uint64(binary.LittleEndian.Uint32(buf[12:]))
+		entry.BlockHardLimit = uint64(binary.LittleEndian.Uint32(buf[16:]))
+		entry.BlockSoftLimit = uint64(binary.LittleEndian.Uint32(buf[20:]))
+		entry.Space = binary.LittleEndian.Uint64(buf[24:])
+		entry.BlockGraceEnd = graceEnd(binary.LittleEndian.Uint64(buf[32:]))
+		entry.InodeGraceEnd = inodeGraceEnd(binary.LittleEndian.Uint64(buf[40:]))
+		return
+	}
+	entry.InodeHardLimit = binary.LittleEndian.Uint64(buf[8:])
+	entry.InodeSoftLimit = binary.LittleEndian.Uint64(buf[16:])
+	entry.Inodes = binary.LittleEndian.Uint64(buf[24:])
+	entry.BlockHardLimit = binary.LittleEndian.Uint64(buf[32:])
+	entry.BlockSoftLimit = binary.LittleEndian.Uint64(buf[40:])
+	entry.Space = binary.LittleEndian.Uint64(buf[48:])
+	entry.BlockGraceEnd = graceEnd(binary.LittleEndian.Uint64(buf[56:]))
+	entry.InodeGraceEnd = inodeGraceEnd(binary.LittleEndian.Uint64(buf[64:]))
+	return
+}
+
+// inodeBytes returns the space the inode is charged for: i_blocks, in filesystem blocks for huge files.
+func (e *ExtFileSystem) inodeBytes(inode DefaultInodeTable) uint64 {
+	blocks := uint64(inode.i_blocks)
+	if e.super.s_feature_ro_compat&EXT4_FEATURE_RO_COMPAT_HUGE_FILE != 0 {
+		blocks |= uint64(binary.LittleEndian.Uint16(inode.i_osd2)) << 32
+		if inode.i_flags&EXT4_HUGE_FILE_FL != 0 {
+			return blocks * e.super.Blocksize()
+		}
+	}
+	return blocks * 512
+}
+
+// QuotaUsage sums up the usage per id from the allocated inodes as e2fsck does: the root and the inodes
+// from s_first_ino on are counted, the quota files aren't.
+func (e *ExtFileSystem) QuotaUsage(quotaType QuotaType) (usage map[uint32]QuotaUsage, err error) {
+	return e.quotaUsage(quotaType)
+}
+
+func (e *ExtFileSystem) quotaUsage(quotaType QuotaType) (map[uint32]QuotaUsage, error) {
+	usage := make(map[uint32]QuotaUsage)
+	for inodeNumber := uint32(1); inodeNumber <= e.super.s_inodes_count; inodeNumber++ {
+		if inodeNumber != ROOTDIRINODE && inodeNumber < e.super.s_first_ino {
+			continue
+		}
+		if inodeNumber == e.super.s_usr_quota_inum || inodeNumber == e.super.s_grp_quota_inum ||
+			inodeNumber == e.super.s_prj_quota_inum {
+			continue
+		}
+		allocated, err := e.inodeAllocated(inodeNumber)
+		if err != nil {
+			return nil, err
+		}
+		if !allocated {
+			continue
+		}
+		inode, err := e.getInode(inodeNumber)
+		if err != nil {
+			return nil, err
+		}
+		var id uint32
+		switch quotaType {
+		case UserQuota:
+			id = inode.uid()
+		case GroupQuota:
+			id = inode.gid()
+		case ProjectQuota:
+			id = inode.i_projid
+		}
+		idUsage := usage[id]
+		idUsage.Space += e.inodeBytes(inode)
+		idUsage.Inodes++
+		usage[id] = idUsage
+	}
+	return usage, nil
+}
+
+// CheckQuota compares the quota file with the inode tables. It returns nil if the filesystem has no such quota.
+func (e *ExtFileSystem) CheckQuota(quotaType QuotaType) (mismatches []QuotaMismatch, err error) {
+	quota, err := e.quota(quotaType)
+	if err != nil || quota == nil {
+		return nil, err
+	}
+	actual, err := e.quotaUsage(quotaType)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[uint32]QuotaUsage)
+	for _, entry := range quota.Entries {
+		recorded[entry.ID] = entry.QuotaUsage
+	}
+	for id, usage := range actual {
+		if recorded[id] != usage {
+			mismatches = append(mismatches, QuotaMismatch{ID: id, Recorded: recorded[id], Actual: usage})
+		}
+	}
+	for id, usage := range recorded {
+		if _, ok := actual[id]; !ok && usage != (QuotaUsage{}) {
+			mismatches = append(mismatches, QuotaMismatch{ID: id, Recorded: usage})
+		}
+	}
+	sort.Slice(mismatches, func(a, b int) bool { return mismatches[a].ID < mismatches[b].ID })
+	return mismatches, nil
+}
+
+// ReadQuota decodes the quota file of the image at targetPath and checks it against the inode tables.
+func ReadQuota(targetPath string, options Options, quotaType QuotaType) (*Quota, []QuotaMismatch, error) {
+	fs, err := Open(targetPath, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fs.Close()
+	quota, err := fs.Quota(quotaType)
+	if err != nil {
+		return nil, nil, err
+	}
+	mismatches, err := fs.CheckQuota(quotaType)
+	return quota, mismatches, err
+}
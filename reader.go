@@ -4,55 +4,139 @@ import (
 	"bytes"
 	"encoding/binary"
 	"github.com/ImSingee/mmap"
-	"log"
 )
 
 type MmapCustomReader struct {
 	cursorPosition int64
 	mmapInstance   *mmap.Mmap
+	base           int64         // where the filesystem starts in the image, the cursor is relative to it
+	overlay        *blockOverlay // shared by all copies of the reader
+	err            error         // the first failed read, see Err
 }
 
-func (m *MmapCustomReader) ReadN(offset int64) (result []byte) {
-	var err error
-	result = make([]byte, offset)
-	_, err = m.mmapInstance.ReadAt(result, m.cursorPosition)
+// blockOverlay keeps the in-memory versions of blocks, e.g. replayed from the journal. Reads see them
+// instead of the image content, so the image is never modified.
+type blockOverlay struct {
+	blocksize int64
+	blocks    map[uint64][]byte
+}
+
+func (o *blockOverlay) patch(buf []byte, offset int64) {
+	if o == nil || len(o.blocks) == 0 {
+		return
+	}
+	end := offset + int64(len(buf))
+	for n := offset / o.blocksize; n*o.blocksize < end; n++ {
+		data, ok := o.blocks[uint64(n)]
+		if !ok {
+			continue
+		}
+		blockStart := n * o.blocksize
+		from := max(offset, blockStart)
+		to := min(end, blockStart+o.blocksize)
+		copy(buf[from-offset:to-offset], data[from-blockStart:to-blockStart])
+	}
+}
+
+// overlayBlock returns the overlay copy of the block for in-place changes. It's made from the current content
+// if the overlay doesn't have the block yet.
+func (m *MmapCustomReader) overlayBlock(n uint64) ([]byte, error) {
+	if data, ok := m.overlay.blocks[n]; ok {
+		return data, nil
+	}
+	if m.overlay.blocks == nil {
+		m.overlay.blocks = make(map[uint64][]byte)
+	}
+	data := make([]byte, m.overlay.blocksize)
+	if err := m.readAt(data, int64(n)*m.overlay.blocksize); err != nil {
+		return nil, ioError("overlayBlock", err)
+	}
+	m.overlay.blocks[n] = data
+	return data, nil
+}
+
+func (m *MmapCustomReader) readAt(buf []byte, offset int64) error {
+	_, err := m.mmapInstance.ReadAt(buf, m.base+offset)
 	if err != nil {
-		log.Panicf("ReadN: %v", err)
+		return err
 	}
+	m.overlay.patch(buf, offset)
+	return nil
+}
+
+func (m *MmapCustomReader) ReadN(offset int64) (result []byte) {
+	result = m.read(int(offset))
 	m.cursorPosition += offset
 	return
 }
 
+// Read64le reads and returns an unsigned int64 at current MmapCustomReader.cursorPosition. The offset are applied after reading.
+func (m *MmapCustomReader) Read64le(offset int64) uint64 {
+	defer func() { m.cursorPosition += offset }()
+	return binary.LittleEndian.Uint64(m.read(8))
+}
+
 // Read32le reads and returns an unsigned int32 at current MmapCustomReader.cursorPosition. The offset are applied after reading.
 func (m *MmapCustomReader) Read32le(offset int64) uint32 {
 	defer func() { m.cursorPosition += offset }()
-	return binary.LittleEndian.Uint32(m.read())
+	return binary.LittleEndian.Uint32(m.read(4))
 }
 
 // Read16le reads and returns an unsigned int16 at current MmapCustomReader.cursorPosition. The offset are applied after reading.
 func (m *MmapCustomReader) Read16le(offset int64) uint16 {
 	defer func() { m.cursorPosition += offset }()
-	return binary.LittleEndian.Uint16(m.read())
+	return binary.LittleEndian.Uint16(m.read(2))
+}
+
+// Read64be is the big-endian Read64le, jbd2 keeps its structures in this byte order.
+func (m *MmapCustomReader) Read64be(offset int64) uint64 {
+	defer func() { m.cursorPosition += offset }()
+	return binary.BigEndian.Uint64(m.read(8))
+}
+
+// Read32be is the big-endian Read32le.
+func (m *MmapCustomReader) Read32be(offset int64) uint32 {
+	defer func() { m.cursorPosition += offset }()
+	return binary.BigEndian.Uint32(m.read(4))
+}
+
+// Read16be is the big-endian Read16le.
+func (m *MmapCustomReader) Read16be(offset int64) uint16 {
+	defer func() { m.cursorPosition += offset }()
+	return binary.BigEndian.Uint16(m.read(2))
 }
 
 func (m *MmapCustomReader) Read8(offset int64) uint8 {
 	defer func() { m.cursorPosition += offset }()
 	var result uint8
-	currentByte := m.read()
+	currentByte := m.read(1)
 	binary.Read(bytes.NewReader(currentByte), binary.BigEndian, &result)
 	return result
 }
 
-func (m *MmapCustomReader) read() (result []byte) {
-	var err error
-	result = make([]byte, 8)
-	_, err = m.mmapInstance.ReadAt(result, m.cursorPosition)
-	if err != nil {
-		log.Panicf("read: %v", err)
+// read returns n bytes at the cursor. A failed read returns zeros and is kept for Err.
+func (m *MmapCustomReader) read(n int) (result []byte) {
+	result = make([]byte, n)
+	if err := m.readAt(result, m.cursorPosition); err != nil {
+		clear(result)
+		if m.err == nil {
+			m.err = ioError("read", err)
+		}
 	}
 	return
 }
 
+// Err returns the failure of the first read that went wrong, nil if none did. The parsers read the fields
+// one by one and check it at the end, like bufio.Scanner.
+func (m *MmapCustomReader) Err() error {
+	return m.err
+}
+
+// size returns the length of the image from the filesystem start.
+func (m *MmapCustomReader) size() int64 {
+	return int64(m.mmapInstance.Cap()) - m.base
+}
+
 func (m *MmapCustomReader) GetCursorValue() *int64 {
 	return &m.cursorPosition
 }
@@ -0,0 +1,185 @@
+package extfs
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	EXT2_BAD_INO         = 1
+	EXT4_USR_QUOTA_INO   = 3
+	EXT4_GRP_QUOTA_INO   = 4
+	EXT2_BOOT_LOADER_INO = 5
+	EXT2_UNDEL_DIR_INO   = 6
+	EXT2_RESIZE_INO      = 7
+	EXT2_JOURNAL_INO     = 8
+	EXT2_EXCLUDE_INO     = 9
+	EXT4_REPLICA_INO     = 10
+)
+
+var reservedInodeNames = map[uint32]string{
+	EXT2_BAD_INO:         "bad blocks",
+	ROOTDIRINODE:         "root directory",
+	EXT4_USR_QUOTA_INO:   "user quota",
+	EXT4_GRP_QUOTA_INO:   "group quota",
+	EXT2_BOOT_LOADER_INO: "boot loader",
+	EXT2_UNDEL_DIR_INO:   "undelete directory",
+	EXT2_RESIZE_INO:      "resize",
+	EXT2_JOURNAL_INO:     "journal",
+	EXT2_EXCLUDE_INO:     "exclude",
+	EXT4_REPLICA_INO:     "replica",
+}
+
+// ReservedInode is one of the inodes below s_first_ino with the blocks it owns.
+type ReservedInode struct {
+	Inode          uint32
+	Name           string
+	Mode           uint16
+	Size           uint64
+	DataBlocks     []uint64
+	MetadataBlocks []uint64 // indirect blocks and extent tree nodes
+}
+
+// ReservedInodes decodes the reserved inodes that are in use, i.e. have a mode, a size or blocks.
+func (e *ExtFileSystem) ReservedInodes() (inodes []ReservedInode, err error) {
+	for inodeNumber := uint32(1); inodeNumber < e.super.s_first_ino && inodeNumber <= e.super.s_inodes_count; inodeNumber++ {
+		reserved, ok, err := e.reservedInode(inodeNumber)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			inodes = append(inodes, reserved)
+		}
+	}
+	return inodes, nil
+}
+
+func (e *ExtFileSystem) reservedInode(inodeNumber uint32) (reserved ReservedInode, ok bool, err error) {
+	defer inodeContext(&err, inodeNumber, "")
+	inode, err := e.getInode(inodeNumber)
+	if err != nil || inode.i_mode == 0 && inode.i_size == 0 && inode.i_blocks == 0 {
+		return reserved, false, err
+	}
+	dataBlocks, err := e.dataBlocks(inode)
+	if err != nil {
+		return reserved, false, err
+	}
+	reserved = ReservedInode{Inode: inodeNumber, Name: reservedInodeNames[inodeNumber], Mode: inode.i_mode,
+		Size: inode.datasize(), DataBlocks: dataBlocks}
+	err = inode.enumMetadataBlocks(e.super, func(block uint64) error {
+		reserved.MetadataBlocks = append(reserved.MetadataBlocks, block)
+		return nil
+	})
+	if err != nil {
+		return reserved, false, err
+	}
+	return reserved, true, nil
+}
+
+// dataBlocks lists the physical blocks of the inode in the logical order, unwritten ones included.
+func (e *ExtFileSystem) dataBlocks(inode DefaultInodeTable) (blocks []uint64, err error) {
+	err = inode.enumRuns(e.super, func(run blockRun) error {
+		for n := uint64(0); n < run.length; n++ {
+			blocks = append(blocks, run.physical+n)
+		}
+		return nil
+	})
+	return
+}
+
+// BadBlocks returns the blocks marked as bad, they are the data blocks of the bad blocks inode.
+func (e *ExtFileSystem) BadBlocks() (blocks []uint64, err error) {
+	defer inodeContext(&err, EXT2_BAD_INO, "")
+	inode, err := e.getInode(EXT2_BAD_INO)
+	if err != nil {
+		return nil, err
+	}
+	if blocks, err = e.dataBlocks(inode); err != nil {
+		return nil, err
+	}
+	sort.Slice(blocks, func(a, b int) bool { return blocks[a] < blocks[b] })
+	return blocks, nil
+}
+
+// ReservedGDTBlocks returns the blocks reserved for the growth of the group descriptor table per group:
+// the primary ones in group 0 and their backups in the groups with superblock backups. The resize inode keeps
+// them as its double-indirect tree: the primary blocks are the indirect blocks and list their backups.
+// It returns nil if the filesystem has no resize inode.
+func (e *ExtFileSystem) ReservedGDTBlocks() (groups map[uint32][]uint64, err error) {
+	if e.super.s_feature_compat&EXT4_FEATURE_COMPAT_RESIZE_INODE == 0 {
+		return nil, nil
+	}
+	defer inodeContext(&err, EXT2_RESIZE_INO, "")
+	inode, err := e.getInode(EXT2_RESIZE_INO)
+	if err != nil {
+		return nil, err
+	}
+	dind := inode.i_block[13]
+	if dind == 0 {
+		return nil, nil
+	}
+	groups = make(map[uint32][]uint64)
+	addBlock := func(block uint64) error {
+		if block < uint64(e.super.s_first_data_block) || block >= e.super.BlocksCount() {
+			return newError("resize inode", ErrCorrupt, "reserved GDT block %d is out of the filesystem", block)
+		}
+		group := uint32((block - uint64(e.super.s_first_data_block)) / uint64(e.super.s_blocks_per_group))
+		groups[group] = append(groups[group], block)
+		return nil
+	}
+	pointers := e.super.Blocksize() / 4
+	dindBuf, err := e.super.readBlock(uint64(dind))
+	if err != nil {
+		return nil, err
+	}
+	for ind := uint64(0); ind < pointers; ind++ {
+		primary := binary.LittleEndian.Uint32(dindBuf[ind*4:])
+		if primary == 0 {
+			continue
+		}
+		if err := addBlock(uint64(primary)); err != nil {
+			return nil, err
+		}
+		buf, err := e.super.readBlock(uint64(primary))
+		if err != nil {
+			return nil, err
+		}
+		for backupInd := uint64(0); backupInd < pointers; backupInd++ {
+			if backup := binary.LittleEndian.Uint32(buf[backupInd*4:]); backup != 0 {
+				if err := addBlock(uint64(backup)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for _, blocks := range groups {
+		sort.Slice(blocks, func(a, b int) bool { return blocks[a] < blocks[b] })
+	}
+	return groups, nil
+}
+
+// ExcludeBitmapBlocks returns the exclude bitmap block of every group (the exclude_bitmap feature of
+// snapshotting filesystems), zero for a group without one. It returns nil if the feature is off.
+func (e *ExtFileSystem) ExcludeBitmapBlocks() (blocks []uint64, err error) {
+	if e.super.s_feature_compat&EXT4_FEATURE_COMPAT_EXCLUDE_BITMAP == 0 {
+		return nil, nil
+	}
+	for group, desc := range e.bgdescs {
+		block := desc.getExcludeBitmapBlock()
+		if block != 0 && (block < uint64(e.super.s_first_data_block) || block >= e.super.BlocksCount()) {
+			return nil, newError("exclude bitmap", ErrCorrupt, "the exclude bitmap of group %d is out of the filesystem: block %d", group, block)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// ReadReservedInodes decodes the reserved inodes of the image at targetPath, see ExtFileSystem.ReservedInodes.
+func ReadReservedInodes(targetPath string, options Options) ([]ReservedInode, error) {
+	fs, err := Open(targetPath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	return fs.ReservedInodes()
+}
@@ -0,0 +1,67 @@
+package extfs
+
+import "context"
+
+// DamageAction tells what Salvage did with the damaged part of the image.
+type DamageAction int
+
+const (
+	DamageSkipped    DamageAction = iota // the entry, the directory block or the metadata record wasn't extracted
+	DamageZeroFilled                     // the file was extracted with zeros in place of the unreadable blocks
+)
+
+func (a DamageAction) String() string {
+	if a == DamageZeroFilled {
+		return "zero-filled"
+	}
+	return "skipped"
+}
+
+// Damage is a problem Salvage went past.
+type Damage struct {
+	Inode  uint32 // zero if it isn't bound to an inode
+	Path   string // the image path, empty for orphans
+	Block  uint64 // the damaged block, zero if it isn't known
+	Action DamageAction
+	Err    *Error
+}
+
+// DamageReport lists the damage in the order it was met.
+type DamageReport struct {
+	Damages []Damage
+}
+
+// Salvage extracts everything readable from a partially corrupted image. Bad inodes, extent trees,
+// indirect and directory blocks and block pointers out of the filesystem don't stop it, they are reported.
+// It returns an error when the image can't be opened at all or the extracted files can't be written.
+func Salvage(targetPath string, pathForExtracting string, options UnpackOptions) (*DamageReport, error) {
+	return SalvageContext(context.Background(), targetPath, pathForExtracting, options)
+}
+
+// SalvageContext is Salvage that stops when the context is done, the error then wraps ctx.Err().
+func SalvageContext(ctx context.Context, targetPath string, pathForExtracting string, options UnpackOptions) (report *DamageReport, err error) {
+	fs, err := Open(targetPath, options.Options)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	report = &DamageReport{}
+	unpacker := FsUnpacker{fs: fs, savePath: pathForExtracting, options: options, damage: report, ctx: ctx}
+	return report, unpacker.perform()
+}
+
+// salvage handles the failure of the work on the inode and the block. In salvage mode it's recorded as
+// the damage and nil is returned, so that the extraction goes on. Otherwise, and for the failures of the host
+// filesystem, the failure is returned to abort the extraction.
+func (f *FsUnpacker) salvage(inodeNumber uint32, path string, block uint64, action DamageAction, err error) error {
+	failure, ok := err.(*Error)
+	if f.damage == nil || !ok || failure.host {
+		return err
+	}
+	if failure.Inode == 0 || failure.Inode == inodeNumber && failure.Path == "" {
+		failure.Inode, failure.Path = inodeNumber, path
+	}
+	damage := Damage{Inode: failure.Inode, Path: failure.Path, Block: block, Action: action, Err: failure}
+	f.damage.Damages = append(f.damage.Damages, damage)
+	return nil
+}
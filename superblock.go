@@ -1,7 +1,5 @@
 package extfs
 
-import "log"
-
 type SuperBlock struct {
 	reader              MmapCustomReader
 	s_inodes_count      uint32
@@ -39,10 +37,80 @@ type SuperBlock struct {
 	s_volume_name       []uint8
 	s_last_mounted      []uint8
 	s_algo_bitmap       uint32
+	// the fields below are meaningful only when s_rev_level > 0 and the corresponding feature is set
+	s_prealloc_blocks         uint8
+	s_prealloc_dir_blocks     uint8
+	s_reserved_gdt_blocks     uint16
+	s_journal_uuid            []uint8
+	s_journal_inum            uint32
+	s_journal_dev             uint32
+	s_last_orphan             uint32
+	s_hash_seed               []uint8
+	s_def_hash_version        uint8
+	s_jnl_backup_type         uint8
+	s_desc_size               uint16
+	s_default_mount_opts      uint32
+	s_first_meta_bg           uint32
+	s_mkfs_time               uint32
+	s_jnl_blocks              []uint8 // the backup of the journal inode i_block and i_size
+	s_blocks_count_hi         uint32
+	s_r_blocks_count_hi       uint32
+	s_free_blocks_count_hi    uint32
+	s_min_extra_isize         uint16
+	s_want_extra_isize        uint16
+	s_flags                   uint32
+	s_raid_stride             uint16
+	s_mmp_interval            uint16
+	s_mmp_block               uint64
+	s_raid_stripe_width       uint32
+	s_log_groups_per_flex     uint8
+	s_checksum_type           uint8
+	s_encryption_level        uint8
+	s_reserved_pad            uint8
+	s_kbytes_written          uint64
+	s_snapshot_inum           uint32
+	s_snapshot_id             uint32
+	s_snapshot_r_blocks_count uint64
+	s_snapshot_list           uint32
+	s_error_count             uint32
+	s_first_error_time        uint32
+	s_first_error_ino         uint32
+	s_first_error_block       uint64
+	s_first_error_func        []uint8
+	s_first_error_line        uint32
+	s_last_error_time         uint32
+	s_last_error_ino          uint32
+	s_last_error_line         uint32
+	s_last_error_block        uint64
+	s_last_error_func         []uint8
+	s_mount_opts              []uint8
+	s_usr_quota_inum          uint32
+	s_grp_quota_inum          uint32
+	s_overhead_clusters       uint32
+	s_backup_bgs              [2]uint32
+	s_encrypt_algos           []uint8
+	s_encrypt_pw_salt         []uint8
+	s_lpf_ino                 uint32
+	s_prj_quota_inum          uint32
+	s_checksum_seed           uint32
+	s_wtime_hi                uint8
+	s_mtime_hi                uint8
+	s_mkfs_time_hi            uint8
+	s_lastcheck_hi            uint8
+	s_first_error_time_hi     uint8
+	s_last_error_time_hi      uint8
+	s_first_error_errcode     uint8
+	s_last_error_errcode      uint8
+	s_encoding                uint16
+	s_encoding_flags          uint16
+	s_orphan_file_inum        uint32
+	s_checksum                uint32
 }
 
-func (e *SuperBlock) Parse(reader MmapCustomReader) {
+// Parse decodes the superblock at the reader cursor.
+func (e *SuperBlock) Parse(reader MmapCustomReader) error {
 	e.reader = reader
+	superBlockPosition := reader.cursorPosition
 	e.s_inodes_count = reader.Read32le(4)
 	e.s_blocks_count = reader.Read32le(4)
 	e.s_r_blocks_count = reader.Read32le(4)
@@ -78,6 +146,76 @@ func (e *SuperBlock) Parse(reader MmapCustomReader) {
 	e.s_volume_name = reader.ReadN(16)
 	e.s_last_mounted = reader.ReadN(64)
 	e.s_algo_bitmap = reader.Read32le(4)
+	e.s_prealloc_blocks = reader.Read8(1)
+	e.s_prealloc_dir_blocks = reader.Read8(1)
+	e.s_reserved_gdt_blocks = reader.Read16le(2)
+	e.s_journal_uuid = reader.ReadN(16)
+	e.s_journal_inum = reader.Read32le(4)
+	e.s_journal_dev = reader.Read32le(4)
+	e.s_last_orphan = reader.Read32le(4)
+	e.s_hash_seed = reader.ReadN(16)
+	e.s_def_hash_version = reader.Read8(1)
+	e.s_jnl_backup_type = reader.Read8(1)
+	e.s_desc_size = reader.Read16le(2)
+	e.s_default_mount_opts = reader.Read32le(4)
+	e.s_first_meta_bg = reader.Read32le(4)
+	e.s_mkfs_time = reader.Read32le(4)
+	e.s_jnl_blocks = reader.ReadN(68)
+	e.s_blocks_count_hi = reader.Read32le(4)
+	e.s_r_blocks_count_hi = reader.Read32le(4)
+	e.s_free_blocks_count_hi = reader.Read32le(4)
+	e.s_min_extra_isize = reader.Read16le(2)
+	e.s_want_extra_isize = reader.Read16le(2)
+	e.s_flags = reader.Read32le(4)
+	e.s_raid_stride = reader.Read16le(2)
+	e.s_mmp_interval = reader.Read16le(2)
+	e.s_mmp_block = reader.Read64le(8)
+	e.s_raid_stripe_width = reader.Read32le(4)
+	e.s_log_groups_per_flex = reader.Read8(1)
+	e.s_checksum_type = reader.Read8(1)
+	e.s_encryption_level = reader.Read8(1)
+	e.s_reserved_pad = reader.Read8(1)
+	e.s_kbytes_written = reader.Read64le(8)
+	e.s_snapshot_inum = reader.Read32le(4)
+	e.s_snapshot_id = reader.Read32le(4)
+	e.s_snapshot_r_blocks_count = reader.Read64le(8)
+	e.s_snapshot_list = reader.Read32le(4)
+	e.s_error_count = reader.Read32le(4)
+	e.s_first_error_time = reader.Read32le(4)
+	e.s_first_error_ino = reader.Read32le(4)
+	e.s_first_error_block = reader.Read64le(8)
+	e.s_first_error_func = reader.ReadN(32)
+	e.s_first_error_line = reader.Read32le(4)
+	e.s_last_error_time = reader.Read32le(4)
+	e.s_last_error_ino = reader.Read32le(4)
+	e.s_last_error_line = reader.Read32le(4)
+	e.s_last_error_block = reader.Read64le(8)
+	e.s_last_error_func = reader.ReadN(32)
+	e.s_mount_opts = reader.ReadN(64)
+	e.s_usr_quota_inum = reader.Read32le(4)
+	e.s_grp_quota_inum = reader.Read32le(4)
+	e.s_overhead_clusters = reader.Read32le(4)
+	e.s_backup_bgs[0] = reader.Read32le(4)
+	e.s_backup_bgs[1] = reader.Read32le(4)
+	e.s_encrypt_algos = reader.ReadN(4)
+	e.s_encrypt_pw_salt = reader.ReadN(16)
+	e.s_lpf_ino = reader.Read32le(4)
+	e.s_prj_quota_inum = reader.Read32le(4)
+	e.s_checksum_seed = reader.Read32le(4)
+	e.s_wtime_hi = reader.Read8(1)
+	e.s_mtime_hi = reader.Read8(1)
+	e.s_mkfs_time_hi = reader.Read8(1)
+	e.s_lastcheck_hi = reader.Read8(1)
+	e.s_first_error_time_hi = reader.Read8(1)
+	e.s_last_error_time_hi = reader.Read8(1)
+	e.s_first_error_errcode = reader.Read8(1)
+	e.s_last_error_errcode = reader.Read8(1)
+	e.s_encoding = reader.Read16le(2)
+	e.s_encoding_flags = reader.Read16le(2)
+	e.s_orphan_file_inum = reader.Read32le(4)
+	reader.SetCursorValue(superBlockPosition + 0x3fc)
+	e.s_checksum = reader.Read32le(4)
+	return reader.Err()
 }
 
 func (e *SuperBlock) Blocksize() uint64 {
@@ -92,10 +230,30 @@ func (e *SuperBlock) BytesPerGroup() uint64 {
 	return uint64(e.s_blocks_per_group) * e.Blocksize()
 }
 
-func (e *SuperBlock) GetBlock(n uint64) *MmapCustomReader {
-	if uint32(n) >= e.s_blocks_count {
-		log.Fatal("getBlock: blocknr too large")
+// BlocksCount returns the number of blocks, s_blocks_count_hi is used only with the 64bit feature.
+func (e *SuperBlock) BlocksCount() uint64 {
+	if e.s_feature_incompat&EXT4_FEATURE_INCOMPAT_64BIT != 0 {
+		return uint64(e.s_blocks_count_hi)<<32 | uint64(e.s_blocks_count)
+	}
+	return uint64(e.s_blocks_count)
+}
+
+// GetBlock returns a new reader at the beginning of the block, so the callers may use it concurrently.
+func (e *SuperBlock) GetBlock(n uint64) (*MmapCustomReader, error) {
+	if n >= e.BlocksCount() {
+		return nil, newError("getBlock", ErrBlockOutOfRange, "block %d, the filesystem has %d", n, e.BlocksCount())
+	}
+	reader := e.reader
+	reader.SetCursorValue(int64(e.Blocksize()) * int64(n))
+	return &reader, nil
+}
+
+// readBlock returns the content of the block.
+func (e *SuperBlock) readBlock(n uint64) ([]byte, error) {
+	reader, err := e.GetBlock(n)
+	if err != nil {
+		return nil, err
 	}
-	e.reader.SetCursorValue(int64(e.Blocksize()) * int64(n))
-	return &e.reader
+	data := reader.ReadN(int64(e.Blocksize()))
+	return data, reader.Err()
 }
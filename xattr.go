@@ -0,0 +1,149 @@
+package extfs
+
+import "encoding/binary"
+
+const EXT4_XATTR_MAGIC = 0xea020000
+const XATTR_SIZE_MAX = 1 << 16
+
+var xattrNamePrefixes = map[uint8]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	6: "security.",
+	7: "system.",
+	8: "system.richacl",
+}
+
+type XattrEntry struct {
+	e_name_len   uint8
+	e_name_index uint8
+	e_value_offs uint16
+	e_value_inum uint32
+	e_value_size uint32
+	e_hash       uint32
+	name         string
+}
+
+// parse decodes the entry at the beginning of buf and returns the entry length with padding.
+func (x *XattrEntry) parse(buf []byte) (int, error) {
+	x.e_name_len = buf[0]
+	x.e_name_index = buf[1]
+	x.e_value_offs = binary.LittleEndian.Uint16(buf[2:])
+	x.e_value_inum = binary.LittleEndian.Uint32(buf[4:])
+	x.e_value_size = binary.LittleEndian.Uint32(buf[8:])
+	x.e_hash = binary.LittleEndian.Uint32(buf[12:])
+	if 16+int(x.e_name_len) > len(buf) {
+		return 0, newError("xattr parse", ErrCorrupt, "the name is out of bounds")
+	}
+	x.name = xattrNamePrefixes[x.e_name_index] + string(buf[16:16+int(x.e_name_len)])
+	return (16 + int(x.e_name_len) + 3) &^ 3, nil
+}
+
+// parseXattrEntries decodes the entry list. The value offsets are relative to valuesBase.
+func (e *ExtFileSystem) parseXattrEntries(entries []byte, valuesBase []byte, xattrs map[string][]byte) error {
+	for len(entries) >= 16 && binary.LittleEndian.Uint32(entries) != 0 {
+		var entry XattrEntry
+		n, err := entry.parse(entries)
+		if err != nil {
+			return err
+		}
+		entries = entries[min(n, len(entries)):]
+		if entry.e_value_size > XATTR_SIZE_MAX {
+			return newError("xattr parse", ErrCorrupt, "the value of %s has %d bytes", entry.name, entry.e_value_size)
+		}
+		if entry.e_value_inum != 0 { // ea_inode feature: the value is the content of another inode
+			inode, err := e.getInode(entry.e_value_inum)
+			if err != nil {
+				return err
+			}
+			if xattrs[entry.name], err = e.readInodeData(inode, uint64(entry.e_value_size)); err != nil {
+				return err
+			}
+			continue
+		}
+		end := int(entry.e_value_offs) + int(entry.e_value_size)
+		if end > len(valuesBase) {
+			return newError("xattr parse", ErrCorrupt, "the value of %s is out of bounds", entry.name)
+		}
+		xattrs[entry.name] = append([]byte(nil), valuesBase[entry.e_value_offs:end]...)
+	}
+	return nil
+}
+
+// getXattrs collects the extended attributes kept in the inode body and in the i_file_acl block.
+func (e *ExtFileSystem) getXattrs(inode DefaultInodeTable) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+	if len(inode.inlineXattrs) > 4 && binary.LittleEndian.Uint32(inode.inlineXattrs) == EXT4_XATTR_MAGIC {
+		area := inode.inlineXattrs[4:]
+		if err := e.parseXattrEntries(area, area, xattrs); err != nil {
+			return nil, err
+		}
+	}
+	if block := inode.fileACL(); block != 0 {
+		buf, err := e.super.readBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(buf) != EXT4_XATTR_MAGIC {
+			return nil, newError("xattr parse", ErrBadMagic, "xattr block %d: %#x", block, binary.LittleEndian.Uint32(buf))
+		}
+		if err := e.parseXattrEntries(buf[32:], buf, xattrs); err != nil {
+			return nil, err
+		}
+	}
+	return xattrs, nil
+}
+
+// readInodeData returns the first size bytes of the inode content. Holes and unwritten runs read as zeros.
+func (e *ExtFileSystem) readInodeData(inode DefaultInodeTable, size uint64) ([]byte, error) {
+	if size > 1<<32*e.super.Blocksize() { // logical block numbers have 32 bits
+		return nil, newError("read", ErrCorrupt, "size %d is beyond the largest file", size)
+	}
+	data := make([]byte, size)
+	if err := e.readInodeRange(inode, data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readInodeRange fills p with the inode content from offset on, the caller keeps it within the size.
+func (e *ExtFileSystem) readInodeRange(inode DefaultInodeTable, p []byte, offset uint64) error {
+	clear(p)
+	blocksize := e.super.Blocksize()
+	end := offset + uint64(len(p))
+	err := inode.enumRuns(e.super, func(run blockRun) error {
+		if run.logical*blocksize >= end {
+			return errStop
+		}
+		if run.unwritten || (run.logical+run.length)*blocksize <= offset {
+			return nil
+		}
+		for n := max(run.logical, offset/blocksize) - run.logical; n < run.length && (run.logical+n)*blocksize < end; n++ {
+			blockStart := (run.logical + n) * blocksize
+			from, to := max(blockStart, offset), min(blockStart+blocksize, end)
+			block, err := e.super.readBlock(run.physical + n)
+			if err != nil {
+				return err
+			}
+			copy(p[from-offset:to-offset], block[from-blockStart:to-blockStart])
+		}
+		return nil
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+// readLink returns the symlink target, which is kept either in i_block (fast symlinks) or in a data block.
+func (e *ExtFileSystem) readLink(inode DefaultInodeTable) (string, error) {
+	if inode.isSymlink() {
+		return inode.symlink[:inode.i_size], nil
+	}
+	if inode.datasize() > e.super.Blocksize() { // the kernel keeps a target in a block at most
+		return "", newError("readlink", ErrCorrupt, "symlink of %d bytes", inode.datasize())
+	}
+	data, err := e.readInodeData(inode, inode.datasize())
+	return string(data), err
+}